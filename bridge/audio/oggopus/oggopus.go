@@ -0,0 +1,99 @@
+// Package oggopus decodes Ogg/Opus audio. It's kept apart from package audio
+// since it needs libopus through cgo.
+package oggopus
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	// the longest packet Opus allows
+	maxPacketDuration = 120 * time.Millisecond
+	// what Opus decodes at natively, other rates are resampled from it
+	opusSampleRate = beep.SampleRate(48000)
+)
+
+// Decode decodes an Ogg/Opus stream, like the ones written by oggwriter, into
+// a streamer of the given format. It expects each Ogg page to hold one Opus
+// packet, which is how oggwriter lays them out.
+func Decode(r io.Reader, format beep.Format) (beep.Streamer, error) {
+	ogg, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := opus.NewDecoder(opusSampleRate.N(time.Second), format.NumChannels)
+	if err != nil {
+		return nil, err
+	}
+	s := &streamer{
+		ogg:       ogg,
+		dec:       dec,
+		channels:  format.NumChannels,
+		decodeBuf: make([]float32, format.NumChannels*opusSampleRate.N(maxPacketDuration)),
+	}
+	return audio.Resample(s, opusSampleRate, format.SampleRate), nil
+}
+
+type streamer struct {
+	ogg       *oggreader.OggReader
+	dec       *opus.Decoder
+	channels  int
+	decodeBuf []float32
+	pcm       []float32
+	err       error
+}
+
+func (s *streamer) Stream(samples [][2]float64) (n int, ok bool) {
+	for n < len(samples) {
+		if len(s.pcm) == 0 && !s.decodeNext() {
+			break
+		}
+		left := float64(s.pcm[0])
+		right := left
+		if s.channels > 1 {
+			right = float64(s.pcm[1])
+		}
+		s.pcm = s.pcm[s.channels:]
+		samples[n] = [2]float64{left, right}
+		n++
+	}
+	return n, n > 0
+}
+
+func (s *streamer) decodeNext() bool {
+	for s.err == nil {
+		payload, _, err := s.ogg.ParseNextPage()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a partially written page at the end of a recording is dropped
+			return false
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if len(payload) == 0 || bytes.HasPrefix(payload, []byte("OpusTags")) {
+			continue
+		}
+		n, err := s.dec.DecodeFloat32(payload, s.decodeBuf)
+		if err != nil {
+			// skip bad packets like the live decoding does
+			continue
+		}
+		if n > 0 {
+			s.pcm = s.decodeBuf[:n*s.channels]
+			return true
+		}
+	}
+	return false
+}
+
+func (s *streamer) Err() error {
+	return s.err
+}
@@ -0,0 +1,183 @@
+package audio
+
+import (
+	"math"
+	"time"
+
+	"github.com/gopxl/beep"
+)
+
+const (
+	// zero crossings of the sinc on each side of the center, more gives a
+	// sharper cutoff at the cost of more work per sample
+	resampleZeros = 16
+	// the Kaiser window beta, trading stopband attenuation for transition width
+	resampleBeta = 8.6
+)
+
+// Resample converts s from one sample rate to another with a polyphase
+// windowed sinc filter, which keeps the frequencies both rates can represent
+// and filters out the rest instead of letting them alias like linear
+// interpolation does.
+func Resample(s beep.Streamer, from, to beep.SampleRate) beep.Streamer {
+	if from == to {
+		return s
+	}
+	g := gcd(int(from), int(to))
+	up, down := int(to)/g, int(from)/g
+	// when downsampling the filter has to cut off at the new Nyquist frequency
+	cutoff := math.Min(1, float64(up)/float64(down))
+	half := int(math.Ceil(resampleZeros / cutoff))
+
+	// one set of taps for each fractional offset an output sample can fall at
+	phases := make([][]float64, up)
+	for p := range phases {
+		taps := make([]float64, 2*half)
+		var sum float64
+		for k := range taps {
+			// distance of input sample k from the output sample
+			d := float64(half-1-k) + float64(p)/float64(up)
+			taps[k] = cutoff * sinc(cutoff*d) * kaiser(d/float64(half))
+			sum += taps[k]
+		}
+		// normalize so every phase passes DC unchanged
+		for k := range taps {
+			taps[k] /= sum
+		}
+		phases[p] = taps
+	}
+	return &resampler{s: s, up: up, down: down, half: half, phases: phases}
+}
+
+// ResampleMargin is how much audio on either side of a span affects the
+// resampled span, for including some context when resampling pieces of a
+// longer stream.
+func ResampleMargin(from, to beep.SampleRate) time.Duration {
+	if from == to {
+		return 0
+	}
+	cutoff := math.Min(1, float64(to)/float64(from))
+	half := int(math.Ceil(resampleZeros / cutoff))
+	return from.D(half)
+}
+
+type resampler struct {
+	s          beep.Streamer
+	up, down   int
+	half       int
+	phases     [][]float64
+	buf        [][2]float64
+	bufStart   int   // input index of buf[0]
+	pos        int64 // output samples streamed
+	inputEnded bool
+	inputLen   int
+	err        error
+	chunk      [512][2]float64
+}
+
+func (r *resampler) Stream(samples [][2]float64) (n int, ok bool) {
+	for n < len(samples) {
+		at := r.pos * int64(r.down)
+		base := int(at / int64(r.up))
+		phase := int(at % int64(r.up))
+		first := base - r.half + 1
+		last := base + r.half
+		for !r.inputEnded && r.bufStart+len(r.buf) <= last {
+			r.fill()
+		}
+		if r.inputEnded && at >= int64(r.inputLen)*int64(r.up) {
+			break
+		}
+		// drop input no longer needed, before first
+		if drop := first - r.bufStart; drop > len(r.chunk) {
+			drop = min(drop, len(r.buf))
+			r.buf = append(r.buf[:0], r.buf[drop:]...)
+			r.bufStart += drop
+		}
+
+		var out [2]float64
+		for k, tap := range r.phases[phase] {
+			i := first + k - r.bufStart
+			// before the start and after the end are silence
+			if i < 0 || i >= len(r.buf) {
+				continue
+			}
+			out[0] += r.buf[i][0] * tap
+			out[1] += r.buf[i][1] * tap
+		}
+		samples[n] = out
+		n++
+		r.pos++
+	}
+	return n, n > 0
+}
+
+func (r *resampler) fill() {
+	m, ok := r.s.Stream(r.chunk[:])
+	r.buf = append(r.buf, r.chunk[:m]...)
+	if !ok {
+		r.inputEnded = true
+		r.inputLen = r.bufStart + len(r.buf)
+		r.err = r.s.Err()
+	}
+}
+
+func (r *resampler) Err() error {
+	return r.err
+}
+
+// Convert converts s from one format to another, resampling it and mixing it
+// down to mono if needed. Precision only matters once audio is encoded, so it
+// isn't changed.
+func Convert(s beep.Streamer, from, to beep.Format) beep.Streamer {
+	s = Resample(s, from.SampleRate, to.SampleRate)
+	if to.NumChannels == 1 && from.NumChannels != 1 {
+		s = &monoStreamer{s}
+	}
+	return s
+}
+
+type monoStreamer struct {
+	beep.Streamer
+}
+
+func (m *monoStreamer) Stream(samples [][2]float64) (int, bool) {
+	n, ok := m.Streamer.Stream(samples)
+	for i := range samples[:n] {
+		mono := (samples[i][0] + samples[i][1]) / 2
+		samples[i] = [2]float64{mono, mono}
+	}
+	return n, ok
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// kaiser is the Kaiser window over -1 to 1.
+func kaiser(x float64) float64 {
+	if x < -1 || x > 1 {
+		return 0
+	}
+	return bessel0(resampleBeta*math.Sqrt(1-x*x)) / bessel0(resampleBeta)
+}
+
+// bessel0 is the zeroth order modified Bessel function of the first kind.
+func bessel0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,74 @@
+package audio
+
+import (
+	"math"
+	"testing"
+
+	"github.com/gopxl/beep"
+	"gotest.tools/assert"
+)
+
+func sine(freq float64, rate beep.SampleRate, n int) [][2]float64 {
+	out := make([][2]float64, n)
+	for i := range out {
+		v := 0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate))
+		out[i] = [2]float64{v, v}
+	}
+	return out
+}
+
+func streamAll(s beep.Streamer) [][2]float64 {
+	var out [][2]float64
+	buf := make([][2]float64, 300)
+	for {
+		n, ok := s.Stream(buf)
+		out = append(out, buf[:n]...)
+		if !ok {
+			return out
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		from, to beep.SampleRate
+	}{
+		{"down", 48000, 16000},
+		{"up", 16000, 48000},
+		{"fractional", 44100, 16000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in := sine(440, tt.from, int(tt.from))
+			out := streamAll(Resample(&sliceStreamer{samples: in}, tt.from, tt.to))
+			assert.Equal(t, int(tt.to), len(out))
+
+			want := sine(440, tt.to, len(out))
+			// the ends are filtered against silence, so only compare the middle
+			margin := tt.to.N(ResampleMargin(tt.from, tt.to))
+			var maxErr float64
+			for i := margin; i < len(out)-margin; i++ {
+				maxErr = math.Max(maxErr, math.Abs(out[i][0]-want[i][0]))
+			}
+			assert.Assert(t, maxErr < 1e-3, "max error %v", maxErr)
+		})
+	}
+
+	// frequencies above the new Nyquist frequency are filtered out instead of
+	// aliasing
+	out := streamAll(Resample(&sliceStreamer{samples: sine(12000, 48000, 48000)}, 48000, 16000))
+	var sum float64
+	for _, s := range out[1000 : len(out)-1000] {
+		sum += s[0] * s[0]
+	}
+	rms := math.Sqrt(sum / float64(len(out)-2000))
+	assert.Assert(t, rms < 1e-3, "rms %v", rms)
+}
+
+func TestConvert(t *testing.T) {
+	in := [][2]float64{{1, 0}, {0.5, 0.5}}
+	out := streamAll(Convert(&sliceStreamer{samples: in},
+		beep.Format{SampleRate: 8000, NumChannels: 2},
+		beep.Format{SampleRate: 8000, NumChannels: 1}))
+	assert.DeepEqual(t, [][2]float64{{0.5, 0.5}, {0.5, 0.5}}, out)
+}
@@ -0,0 +1,368 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/gopxl/beep"
+)
+
+// SampleFormat is how each sample is stored in a WAV file.
+type SampleFormat int
+
+const (
+	Int16 SampleFormat = iota
+	Int24
+	Float32
+)
+
+func (f SampleFormat) size() int {
+	switch f {
+	case Int24:
+		return 3
+	case Float32:
+		return 4
+	default:
+		return 2
+	}
+}
+
+type WavFormat struct {
+	SampleRate   beep.SampleRate
+	NumChannels  int
+	SampleFormat SampleFormat
+}
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xfffe
+
+	// the size fields of a stream that can't be seeked back to are left at
+	// their maximum, which readers take as lasting until the end
+	wavUnknownSize = 0xffffffff
+)
+
+// WavWriter encodes audio to WAV as it's written. If the underlying writer can
+// seek, the sizes in the header are filled in by Close, otherwise they are
+// left unknown and readers will read until the end of the stream.
+type WavWriter struct {
+	w      io.Writer
+	format WavFormat
+	buf    []byte
+	size   int64
+	// start of the header if w can seek back to it
+	seeker io.WriteSeeker
+	start  int64
+}
+
+func NewWavWriter(w io.Writer, format WavFormat) (*WavWriter, error) {
+	if format.NumChannels < 1 {
+		return nil, fmt.Errorf("wav: invalid channel count %d", format.NumChannels)
+	}
+	ww := &WavWriter{w: w, format: format}
+	if s, ok := w.(io.WriteSeeker); ok {
+		// pipes and the like can be files that fail to seek
+		if start, err := s.Seek(0, io.SeekCurrent); err == nil {
+			ww.seeker, ww.start = s, start
+		}
+	}
+	if err := ww.writeHeader(wavUnknownSize); err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+func (w *WavWriter) writeHeader(dataSize uint32) error {
+	tag := uint16(wavFormatPCM)
+	if w.format.SampleFormat == Float32 {
+		tag = wavFormatFloat
+	}
+	size := w.format.SampleFormat.size()
+	riffSize := uint32(wavUnknownSize)
+	if dataSize != wavUnknownSize {
+		riffSize = 36 + dataSize + dataSize%2
+	}
+	var h [44]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], riffSize)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], tag)
+	binary.LittleEndian.PutUint16(h[22:], uint16(w.format.NumChannels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(w.format.SampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(int(w.format.SampleRate)*w.format.NumChannels*size))
+	binary.LittleEndian.PutUint16(h[32:], uint16(w.format.NumChannels*size))
+	binary.LittleEndian.PutUint16(h[34:], uint16(8*size))
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataSize)
+	_, err := w.w.Write(h[:])
+	return err
+}
+
+// Write encodes stereo samples, downmixing them if the format is mono. Use
+// WriteChannels for more than two channels.
+func (w *WavWriter) Write(samples [][2]float64) error {
+	switch w.format.NumChannels {
+	case 1:
+		mono := make([]float64, len(samples))
+		for i, s := range samples {
+			mono[i] = (s[0] + s[1]) / 2
+		}
+		return w.WriteChannels(mono)
+	case 2:
+		left := make([]float64, len(samples))
+		right := make([]float64, len(samples))
+		for i, s := range samples {
+			left[i], right[i] = s[0], s[1]
+		}
+		return w.WriteChannels(left, right)
+	}
+	return fmt.Errorf("wav: can't write stereo samples as %d channels", w.format.NumChannels)
+}
+
+// WriteChannels encodes the samples of each channel, which must all be the
+// same length.
+func (w *WavWriter) WriteChannels(channels ...[]float64) error {
+	if len(channels) != w.format.NumChannels {
+		return fmt.Errorf("wav: got %d channels, want %d", len(channels), w.format.NumChannels)
+	}
+	frames := len(channels[0])
+	size := w.format.SampleFormat.size()
+	w.buf = w.buf[:0]
+	for i := 0; i < frames; i++ {
+		for _, ch := range channels {
+			w.buf = appendSample(w.buf, w.format.SampleFormat, ch[i])
+		}
+	}
+	n, err := w.w.Write(w.buf)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if n != frames*len(channels)*size {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// Close pads the data to an even length and fills in the sizes in the header
+// if the writer can seek. It doesn't close the underlying writer.
+func (w *WavWriter) Close() error {
+	if w.size%2 == 1 {
+		if _, err := w.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if w.seeker == nil {
+		return nil
+	}
+	if w.size > math.MaxUint32-36 {
+		return errors.New("wav: audio too long for the header")
+	}
+	end, err := w.seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.seeker.Seek(w.start, io.SeekStart); err != nil {
+		return err
+	}
+	if err := w.writeHeader(uint32(w.size)); err != nil {
+		return err
+	}
+	_, err = w.seeker.Seek(end, io.SeekStart)
+	return err
+}
+
+func appendSample(buf []byte, format SampleFormat, v float64) []byte {
+	switch format {
+	case Float32:
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+	case Int24:
+		i := int32(clamp(v) * (1<<23 - 1))
+		return append(buf, byte(i), byte(i>>8), byte(i>>16))
+	default:
+		return binary.LittleEndian.AppendUint16(buf, uint16(int16(clamp(v)*(1<<15-1))))
+	}
+}
+
+func clamp(v float64) float64 {
+	return min(max(v, -1), 1)
+}
+
+// EncodeWav writes all of s to w as WAV, mono or stereo.
+func EncodeWav(w io.Writer, format WavFormat, s beep.Streamer) error {
+	ww, err := NewWavWriter(w, format)
+	if err != nil {
+		return err
+	}
+	samples := make([][2]float64, 4096)
+	for {
+		n, ok := s.Stream(samples)
+		if n > 0 {
+			if err := ww.Write(samples[:n]); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			if err := s.Err(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return ww.Close()
+}
+
+// WavStreamer decodes WAV as it's streamed. Mono is played on both sides and
+// more than two channels are mixed down to mono.
+type WavStreamer struct {
+	r      *bufio.Reader
+	format WavFormat
+	// bytes left in the data chunk, or -1 until the end of the stream
+	remaining int64
+	frame     []byte
+	err       error
+}
+
+// DecodeWav reads the WAV header from r, leaving it at the start of the
+// audio to be streamed.
+func DecodeWav(r io.Reader) (*WavStreamer, error) {
+	br := bufio.NewReader(r)
+	var riff [12]byte
+	if _, err := io.ReadFull(br, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("wav: not a WAV file")
+	}
+	ws := &WavStreamer{r: br}
+	var haveFormat bool
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(br, chunk[:]); err != nil {
+			return nil, err
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:])
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("wav: fmt chunk too short")
+			}
+			fmtChunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(br, fmtChunk); err != nil {
+				return nil, err
+			}
+			format, err := parseWavFormat(fmtChunk)
+			if err != nil {
+				return nil, err
+			}
+			ws.format = format
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return nil, errors.New("wav: data before fmt chunk")
+			}
+			ws.remaining = int64(size)
+			if size == wavUnknownSize || size == 0 {
+				ws.remaining = -1
+			}
+			ws.frame = make([]byte, ws.format.NumChannels*ws.format.SampleFormat.size())
+			return ws, nil
+		default:
+			if _, err := br.Discard(int(size + size%2)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func parseWavFormat(chunk []byte) (WavFormat, error) {
+	tag := binary.LittleEndian.Uint16(chunk[0:])
+	if tag == wavFormatExtensible && len(chunk) >= 26 {
+		// the actual format is the start of the sub format GUID
+		tag = binary.LittleEndian.Uint16(chunk[24:])
+	}
+	format := WavFormat{
+		NumChannels: int(binary.LittleEndian.Uint16(chunk[2:])),
+		SampleRate:  beep.SampleRate(binary.LittleEndian.Uint32(chunk[4:])),
+	}
+	bits := binary.LittleEndian.Uint16(chunk[14:])
+	switch {
+	case tag == wavFormatPCM && bits == 16:
+		format.SampleFormat = Int16
+	case tag == wavFormatPCM && bits == 24:
+		format.SampleFormat = Int24
+	case tag == wavFormatFloat && bits == 32:
+		format.SampleFormat = Float32
+	default:
+		return format, fmt.Errorf("wav: unsupported format %d with %d bits", tag, bits)
+	}
+	if format.NumChannels < 1 {
+		return format, errors.New("wav: no channels")
+	}
+	return format, nil
+}
+
+func (s *WavStreamer) Format() WavFormat {
+	return s.format
+}
+
+func (s *WavStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	if s.err != nil {
+		return 0, false
+	}
+	size := s.format.SampleFormat.size()
+	for n < len(samples) {
+		if s.remaining >= 0 && s.remaining < int64(len(s.frame)) {
+			break
+		}
+		if _, err := io.ReadFull(s.r, s.frame); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				s.err = err
+			}
+			break
+		}
+		if s.remaining > 0 {
+			s.remaining -= int64(len(s.frame))
+		}
+		var sum float64
+		for c := 0; c < s.format.NumChannels; c++ {
+			v := readSample(s.frame[c*size:], s.format.SampleFormat)
+			samples[n][c%2] = v
+			sum += v
+		}
+		switch s.format.NumChannels {
+		case 1:
+			samples[n][1] = samples[n][0]
+		case 2:
+		default:
+			mono := sum / float64(s.format.NumChannels)
+			samples[n] = [2]float64{mono, mono}
+		}
+		n++
+	}
+	return n, n > 0
+}
+
+func (s *WavStreamer) Err() error {
+	return s.err
+}
+
+func readSample(b []byte, format SampleFormat) float64 {
+	switch format {
+	case Float32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case Int24:
+		// shift up to the top of an int32 to get the sign
+		i := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+		return float64(i) / (1 << 23)
+	default:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	}
+}
@@ -0,0 +1,114 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/gopxl/beep"
+	"github.com/gopxl/beep/generators"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestWavRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		format    WavFormat
+		tolerance float64
+	}{
+		{"mono 16-bit", WavFormat{SampleRate: 16000, NumChannels: 1, SampleFormat: Int16}, 1.0 / (1 << 14)},
+		{"stereo 16-bit", WavFormat{SampleRate: 48000, NumChannels: 2, SampleFormat: Int16}, 1.0 / (1 << 14)},
+		{"mono 24-bit", WavFormat{SampleRate: 16000, NumChannels: 1, SampleFormat: Int24}, 1.0 / (1 << 22)},
+		{"stereo float", WavFormat{SampleRate: 44100, NumChannels: 2, SampleFormat: Float32}, 1e-7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tone, err := generators.SineTone(tt.format.SampleRate, 440)
+			require.NoError(t, err)
+			in := make([][2]float64, 1001)
+			tone.Stream(in)
+			if tt.format.NumChannels == 2 {
+				// make the sides differ
+				for i := range in {
+					in[i][1] = -in[i][1] / 2
+				}
+			}
+
+			// seekable output gets the real sizes in the header
+			out := NewByteSliceWriteSeeker(1024)
+			require.NoError(t, EncodeWav(out, tt.format, &sliceStreamer{samples: in}))
+			data := out.Bytes()
+			dataSize := len(in) * tt.format.NumChannels * tt.format.SampleFormat.size()
+			assert.Equal(t, uint32(dataSize), binary.LittleEndian.Uint32(data[40:]))
+			assert.Equal(t, 44+dataSize+dataSize%2, len(data))
+
+			// unseekable output leaves them unknown
+			var stream bytes.Buffer
+			require.NoError(t, EncodeWav(&stream, tt.format, &sliceStreamer{samples: in}))
+			assert.Equal(t, uint32(wavUnknownSize), binary.LittleEndian.Uint32(stream.Bytes()[40:]))
+
+			for _, encoded := range [][]byte{data, stream.Bytes()} {
+				dec, err := DecodeWav(bytes.NewReader(encoded))
+				require.NoError(t, err)
+				assert.Equal(t, tt.format, dec.Format())
+				buf := beep.NewBuffer(beep.Format{SampleRate: tt.format.SampleRate, NumChannels: 2, Precision: 4})
+				buf.Append(dec)
+				require.NoError(t, dec.Err())
+				assert.Equal(t, len(in), buf.Len())
+				got := make([][2]float64, buf.Len())
+				buf.Streamer(0, buf.Len()).Stream(got)
+				for i := range in {
+					want := in[i]
+					if tt.format.NumChannels == 1 {
+						mono := (want[0] + want[1]) / 2
+						want = [2]float64{mono, mono}
+					}
+					for c := 0; c < 2; c++ {
+						// beep.Buffer stores samples at its own precision
+						assert.Assert(t, abs(got[i][c]-want[c]) < tt.tolerance+1.0/(1<<30), "sample %d channel %d: %v != %v", i, c, got[i][c], want[c])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWavChannels(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewWavWriter(&out, WavFormat{SampleRate: 8000, NumChannels: 3, SampleFormat: Float32})
+	require.NoError(t, err)
+	assert.ErrorContains(t, w.Write(make([][2]float64, 10)), "3 channels")
+	require.NoError(t, w.WriteChannels([]float64{0.25, 0.5}, []float64{0.5, 0.5}, []float64{0.75, 0.5}))
+	require.NoError(t, w.Close())
+
+	dec, err := DecodeWav(&out)
+	require.NoError(t, err)
+	got := make([][2]float64, 4)
+	n, ok := dec.Stream(got)
+	assert.Assert(t, ok)
+	assert.Equal(t, 2, n)
+	// more than two channels are mixed down
+	assert.DeepEqual(t, [][2]float64{{0.5, 0.5}, {0.5, 0.5}}, got[:n])
+}
+
+type sliceStreamer struct {
+	samples [][2]float64
+}
+
+func (s *sliceStreamer) Stream(samples [][2]float64) (int, bool) {
+	if len(s.samples) == 0 {
+		return 0, false
+	}
+	n := copy(samples, s.samples)
+	s.samples = s.samples[n:]
+	return n, true
+}
+
+func (s *sliceStreamer) Err() error { return nil }
+
+func abs(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -5,45 +5,19 @@ import (
 	"fmt"
 	"io"
 
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
+	"github.com/gopxl/beep"
 )
 
-func float32ToInt16(f []float32) []int {
-	int16Data := make([]int, len(f))
-	for i, v := range f {
-		if v < -1 {
-			v = -1
-		} else if v > 1 {
-			v = 1
-		}
-		int16Data[i] = int(v * 32767)
-	}
-	return int16Data
-}
-
 func ToWav(pcmData []float32, sampleRate int) ([]byte, error) {
-
-	int16PCMData := float32ToInt16(pcmData)
-
 	out := NewByteSliceWriteSeeker(1024)
-
-	// Create a new encoder
-	enc := wav.NewEncoder(out, sampleRate, 16, 1, 1)
-
-	// Convert int16 PCM data to an audio.IntBuffer
-	buf := &audio.IntBuffer{Data: int16PCMData, Format: &audio.Format{SampleRate: sampleRate, NumChannels: 1}}
-
-	// Write the buffer to the encoder
-	if err := enc.Write(buf); err != nil {
-		return nil, fmt.Errorf("Error writing to WAV file: %v", err)
+	format := WavFormat{
+		SampleRate:   beep.SampleRate(sampleRate),
+		NumChannels:  1,
+		SampleFormat: Int16,
 	}
-
-	// Close the encoder to flush any remaining data
-	if err := enc.Close(); err != nil {
-		return nil, fmt.Errorf("Error closing WAV file: %v", err)
+	if err := EncodeWav(out, format, &Float32Stream{Samples: pcmData}); err != nil {
+		return nil, fmt.Errorf("Error writing WAV file: %v", err)
 	}
-
 	return out.Bytes(), nil
 }
 
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -18,8 +21,12 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/progrium/webrtc-sessions/bridge/audio/oggopus"
+	"github.com/progrium/webrtc-sessions/bridge/diarize"
+	"github.com/progrium/webrtc-sessions/bridge/export"
 	"github.com/progrium/webrtc-sessions/bridge/tracks"
 	"github.com/progrium/webrtc-sessions/bridge/transcribe"
+	"github.com/progrium/webrtc-sessions/bridge/translate"
 	"github.com/progrium/webrtc-sessions/bridge/ui"
 	"github.com/progrium/webrtc-sessions/bridge/vad"
 	"github.com/progrium/webrtc-sessions/bridge/webrtc/js"
@@ -30,40 +37,63 @@ import (
 )
 
 func main() {
+	// tracks are kept at full quality, agents convert the audio to what they
+	// need themselves
 	format := beep.Format{
-		SampleRate:  beep.SampleRate(16000),
-		NumChannels: 1,
-		Precision:   4,
+		SampleRate:  beep.SampleRate(48000),
+		NumChannels: 2,
+		Precision:   2,
 	}
 	fatal(speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10)))
 
+	store := tracks.NewFileStore("./sessions")
+	// keep events recorded by agents this build doesn't have
+	store.Tolerant = true
+
 	engine.Run(
 		Main{
 			format: format,
+			store:  store,
 		},
 		vad.New(vad.Config{
-			SampleRate:   format.SampleRate.N(time.Second),
+			SampleRate:   16000,
 			SampleWindow: 24 * time.Second,
 		}),
-		transcribe.Agent{
+		transcribe.New(transcribe.Config{
 			Endpoint: "http://localhost:8090/v1/transcribe",
-		},
+		}),
+		diarize.New(diarize.Config{
+			Endpoint: "http://localhost:8093/v1/diarize",
+		}),
+		// comma separated languages for subtitles, like "english,spanish"
+		translate.New(translate.Config{
+			Endpoint: "http://localhost:8092/v1/transcribe",
+			Targets:  languages(os.Getenv("TRANSLATE_LANGUAGES")),
+		}),
 		eventLogger{
 			exclude: []string{"audio"},
 		},
 	)
 }
 
+func languages(s string) (langs []string) {
+	for _, lang := range strings.Split(s, ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			langs = append(langs, lang)
+		}
+	}
+	return
+}
+
 type eventLogger struct {
 	exclude []string
 }
 
+func (l eventLogger) Subscription() tracks.Filter {
+	return tracks.Filter{ExcludeTypes: l.exclude}
+}
+
 func (l eventLogger) HandleEvent(e tracks.Event) {
-	for _, t := range l.exclude {
-		if e.Type == t {
-			return
-		}
-	}
 	log.Printf("event: %s %s %s", e.Type, e.ID, time.Duration(e.Start))
 }
 
@@ -71,6 +101,7 @@ type Main struct {
 	EventHandlers []tracks.Handler
 
 	sessions map[string]*Session
+	store    tracks.Store
 	format   beep.Format
 
 	mu sync.Mutex
@@ -80,10 +111,36 @@ type Session struct {
 	*tracks.Session
 	sfu  *sfu.Session
 	peer *local.Peer
+
+	// readOnly sessions were loaded from disk and are only served for review
+	readOnly bool
+	// saveFailed is set while the session can't be written to the store
+	saveFailed atomic.Bool
+}
+
+// persist appends the event to the store. A failed write, like on a full
+// disk, only stops that session from being saved instead of taking down the
+// server. Each event after it tries a full save to catch up.
+func (m *Main) persist(sess *Session, e tracks.Event) {
+	var err error
+	if sess.saveFailed.Load() {
+		err = m.store.SaveSession(sess.Session)
+	} else {
+		err = m.store.AppendEvent(e)
+	}
+	if err != nil {
+		if !sess.saveFailed.Swap(true) {
+			log.Printf("session %s: save: %v, retrying with the next event", sess.ID, err)
+		}
+		return
+	}
+	if sess.saveFailed.Swap(false) {
+		log.Printf("session %s: saved again", sess.ID)
+	}
 }
 
 type View struct {
-	Sessions []string
+	Sessions []tracks.ID
 	Session  *Session
 }
 
@@ -94,46 +151,119 @@ func fatal(err error) {
 }
 
 func (m *Main) TerminateDaemon(ctx context.Context) error {
+	// sessions can still be started while saving
+	m.mu.Lock()
+	var sessions []*Session
 	for _, sess := range m.sessions {
-		if err := saveSession(sess); err != nil {
+		sessions = append(sessions, sess)
+	}
+	m.mu.Unlock()
+	for _, sess := range sessions {
+		if sess.readOnly {
+			continue
+		}
+		if err := m.store.SaveSession(sess.Session); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func saveSession(sess *Session) error {
-	b, err := cbor.Marshal(sess)
+// loadSession reads a saved session and the audio of its tracks back from the
+// store. Tracks recorded before their audio was kept in the store fall back to
+// the Ogg recording.
+func (m *Main) loadSession(id string) (*Session, error) {
+	loaded, err := m.store.LoadSession(tracks.ID(id))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	filename := fmt.Sprintf("./sessions/%s/session", sess.ID)
-	if err := os.WriteFile(filename, b, 0644); err != nil {
-		return err
+	sess := &Session{
+		Session:  loaded,
+		readOnly: true,
 	}
-	// for debugging!
-	// b, err = json.Marshal(sess)
-	// if err != nil {
-	// 	return err
-	// }
-	// filename = fmt.Sprintf("./sessions/%s/session.json", id)
-	// if err := os.WriteFile(filename, b, 0644); err != nil {
-	// 	return err
-	// }
-	return nil
+	for _, track := range sess.Tracks() {
+		if track.End() > track.Start() {
+			continue
+		}
+		f, err := os.Open(fmt.Sprintf("./sessions/%s/track-%s.ogg", sess.ID, track.ID))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, err := oggopus.Decode(f, track.AudioFormat())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		track.AddAudio(s)
+		f.Close()
+	}
+	return sess, nil
 }
 
-func (m *Main) SavedSessions() (names []string, err error) {
-	dir, err := os.ReadDir("./sessions")
+// session returns the running session with the given ID, loading it from the
+// store if it isn't running.
+func (m *Main) session(id string) (*Session, error) {
+	m.mu.Lock()
+	sess, found := m.sessions[id]
+	m.mu.Unlock()
+	if found {
+		return sess, nil
+	}
+	loaded, err := m.loadSession(id)
 	if err != nil {
 		return nil, err
 	}
-	for _, fi := range dir {
-		if fi.IsDir() {
-			names = append(names, fi.Name())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sess, found = m.sessions[id]; !found {
+		sess = loaded
+		m.sessions[id] = sess
+	}
+	return sess, nil
+}
+
+// serveAudio serves the audio of the session for download, as WAV with a
+// channel per track or with ?format=ogg as mixed down Ogg/Opus.
+func serveAudio(w http.ResponseWriter, r *http.Request, sess *Session) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "wav":
+		// the WAV header is written last, so it needs somewhere to seek
+		f, err := os.CreateTemp("", "export-*.wav")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err := export.WAV(f, sess.Session); err != nil {
+			exportError(w, err)
+			return
 		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sess.ID+".wav"))
+		http.ServeContent(w, r, string(sess.ID)+".wav", sess.Start, f)
+	case "ogg":
+		var buf bytes.Buffer
+		if err := export.Ogg(&buf, sess.Session); err != nil {
+			exportError(w, err)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sess.ID+".ogg"))
+		http.ServeContent(w, r, string(sess.ID)+".ogg", sess.Start, bytes.NewReader(buf.Bytes()))
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
 	}
-	return
+}
+
+func exportError(w http.ResponseWriter, err error) {
+	if errors.Is(err, export.ErrNoAudio) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Println("export:", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
 func (m *Main) StartSession(sess *Session) {
@@ -147,7 +277,7 @@ func (m *Main) StartSession(sess *Session) {
 		if track.Kind() != webrtc.RTPCodecTypeAudio {
 			return
 		}
-		ogg, err := oggwriter.New(fmt.Sprintf("./sessions/%s/track-%s.ogg", sess.ID, track.ID()), uint32(m.format.SampleRate.N(time.Second)), uint16(m.format.NumChannels))
+		ogg, err := oggwriter.New(fmt.Sprintf("./sessions/%s/track-%s.ogg", sess.ID, sessTrack.ID), uint32(m.format.SampleRate.N(time.Second)), uint16(m.format.NumChannels))
 		fatal(err)
 		defer ogg.Close()
 		rtp := trackstreamer.Tee(track, ogg)
@@ -159,11 +289,18 @@ func (m *Main) StartSession(sess *Session) {
 			// since Track.AddAudio expects finite segments, split it into chunks of
 			// a smaller size we can append incrementally
 			chunk := beep.Take(chunkSize, s)
+			end := sessTrack.End()
 			sessTrack.AddAudio(chunk)
 			fatal(chunk.Err())
+			if sessTrack.End() == end {
+				// the remote track ended
+				sessTrack.Close()
+				return
+			}
 		}
 	})
 	sess.peer.HandleSignals()
+	sess.Close()
 }
 
 // Return a channel which will be notified when the session receives a new
@@ -173,10 +310,6 @@ func (m *Main) StartSession(sess *Session) {
 func sessionUpdateHandler(ctx context.Context, sess *Session) chan struct{} {
 	ch := make(chan struct{}, 1)
 	h := tracks.HandlerFunc(func(e tracks.Event) {
-		if e.Type == "audio" {
-			// if this is a transient event like "audio" we don't need to save
-			return
-		}
 		select {
 		case ch <- struct{}{}:
 		default:
@@ -187,7 +320,8 @@ func sessionUpdateHandler(ctx context.Context, sess *Session) chan struct{} {
 		sess.Unlisten(h)
 		close(ch)
 	}()
-	sess.Listen(h)
+	// transient events like "audio" don't change what the UI shows
+	sess.Subscribe(h, tracks.Filter{ExcludeTypes: []string{"audio"}})
 	return ch
 }
 
@@ -207,30 +341,44 @@ func (m *Main) Serve(ctx context.Context) {
 		for _, h := range m.EventHandlers {
 			sess.Listen(h)
 		}
-		go func() {
-			for range sessionUpdateHandler(ctx, sess) {
-				log.Printf("saving session")
-				fatal(saveSession(sess))
-			}
-		}()
+		// transient events like "audio" don't need to be saved
+		sess.Subscribe(tracks.HandlerFunc(func(e tracks.Event) {
+			m.persist(sess, e)
+		}), tracks.Filter{ExcludeTypes: []string{"audio"}})
 		m.sessions[string(sess.ID)] = sess
 		m.mu.Unlock()
-		fatal(os.MkdirAll(fmt.Sprintf("./sessions/%s", sess.ID), 0744))
+		if err := m.store.SaveSession(sess.Session); err != nil {
+			// it's retried with the first event
+			log.Printf("session %s: save: %v", sess.ID, err)
+			sess.saveFailed.Store(true)
+		}
 		go m.StartSession(sess)
 		http.Redirect(w, r, fmt.Sprintf("/sessions/%s", sess.ID), http.StatusFound)
 	})
 
 	http.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
-		sessID := filepath.Base(r.URL.Path)
+		sessID, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
 
-		m.mu.Lock()
-		sess, found := m.sessions[sessID]
-		m.mu.Unlock()
-
-		if !found {
+		sess, err := m.session(sessID)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("load:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch sub {
+		case "":
+		case "audio":
+			serveAudio(w, r, sess)
+			return
+		default:
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+
 		updateCtx, cancel := context.WithCancel(ctx)
 		defer cancel()
 		updateCh := sessionUpdateHandler(updateCtx, sess)
@@ -246,6 +394,10 @@ func (m *Main) Serve(ctx context.Context) {
 				return
 			}
 			if r.URL.RawQuery == "sfu" {
+				if sess.readOnly {
+					log.Print("peer: session is read-only")
+					return
+				}
 				peer, err := sess.sfu.AddPeer(conn)
 				if err != nil {
 					log.Print("peer:", err)
@@ -257,7 +409,7 @@ func (m *Main) Serve(ctx context.Context) {
 				for range updateCh {
 					// TODO check periodically for new sessions even if there's not an
 					// update on this session
-					names, err := m.SavedSessions()
+					names, err := m.store.Sessions()
 					fatal(err)
 					data, err := cbor.Marshal(View{
 						Sessions: names,
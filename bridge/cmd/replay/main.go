@@ -0,0 +1,96 @@
+// Command replay runs the bridge agents over a saved session, for tuning them
+// against recordings instead of live calls.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/progrium/webrtc-sessions/bridge/diarize"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"github.com/progrium/webrtc-sessions/bridge/transcribe"
+	"github.com/progrium/webrtc-sessions/bridge/translate"
+	"github.com/progrium/webrtc-sessions/bridge/vad"
+)
+
+func main() {
+	dir := flag.String("dir", "./sessions", "directory of saved sessions")
+	speed := flag.Float64("speed", 0, "replay speed relative to real time, 0 for as fast as possible")
+	endpoint := flag.String("transcribe", "", "transcription endpoint, or command for the pipe backend, transcription is skipped if empty")
+	backend := flag.String("transcribe-backend", "http", "transcription backend: http, openai (key in $OPENAI_API_KEY), pipe, fake or stream for a websocket streaming server")
+	translator := flag.String("translate", "", "translator service endpoint, transcriptions are translated if set")
+	targets := flag.String("languages", "english", "comma separated languages to translate into")
+	diarizer := flag.String("diarize", "", "diarizer service endpoint, or command for a pipe diarizer like minibridge's diarize.py, speakers are skipped if empty")
+	save := flag.Bool("save", false, "save the replayed session to the sessions directory")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: replay [flags] <session-id>")
+	}
+
+	store := tracks.NewFileStore(*dir)
+	store.Tolerant = true
+	src, err := store.LoadSession(tracks.ID(flag.Arg(0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	replay := tracks.NewReplay(src)
+	replay.Speed = *speed
+	sess := replay.Session
+	sess.Listen(vad.New(vad.Config{
+		SampleRate:   16000,
+		SampleWindow: 24 * time.Second,
+	}))
+	if *backend == "stream" && *endpoint != "" {
+		sess.Listen(&transcribe.StreamAgent{Endpoint: *endpoint})
+	} else if *endpoint != "" || *backend == string(transcribe.Fake) {
+		config := transcribe.Config{
+			Backend:  transcribe.Backend(*backend),
+			Endpoint: *endpoint,
+			APIKey:   os.Getenv("OPENAI_API_KEY"),
+			Text:     "fake transcription",
+		}
+		if config.Backend == transcribe.Pipe {
+			config.Endpoint = ""
+			config.Command = strings.Fields(*endpoint)
+		}
+		t, err := transcribe.NewTranscriber(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sess.Listen(&transcribe.Agent{Transcriber: t})
+	}
+	if *diarizer != "" {
+		config := diarize.Config{Endpoint: *diarizer}
+		if !strings.Contains(*diarizer, "://") {
+			config.Backend = diarize.Pipe
+			config.Command = strings.Fields(*diarizer)
+		}
+		sess.Listen(diarize.New(config))
+	}
+	if *translator != "" {
+		sess.Listen(translate.New(translate.Config{
+			Endpoint: *translator,
+			Targets:  strings.Split(*targets, ","),
+		}))
+	}
+	sess.Subscribe(tracks.HandlerFunc(func(e tracks.Event) {
+		log.Printf("event: %s %s %s-%s", e.Type, e.ID, time.Duration(e.Start), time.Duration(e.End))
+	}), tracks.Filter{ExcludeTypes: []string{"audio"}})
+
+	if err := replay.Run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	sess.Wait()
+
+	if *save {
+		if err := store.SaveSession(sess); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("saved replay as session %s", sess.ID)
+	}
+}
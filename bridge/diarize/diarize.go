@@ -0,0 +1,171 @@
+package diarize
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+)
+
+// Format is the audio pyannote expects.
+var Format = beep.Format{
+	SampleRate:  16000,
+	NumChannels: 1,
+	Precision:   2,
+}
+
+func init() {
+	tracks.RegisterEvent[*Speaker]("speaker")
+}
+
+// Timespan is when someone spoke, in seconds since the start of the audio.
+// Speakers are labeled like "SPEAKER_00", the labels only mean the same
+// person within one diarization.
+type Timespan struct {
+	Start   float32 `json:"start"`
+	End     float32 `json:"end"`
+	Speaker string  `json:"speaker"`
+}
+
+// Diarizer tells apart who spoke when. The audio is mono and in Format.
+type Diarizer interface {
+	Diarize(ctx context.Context, pcm []float32) ([]Timespan, error)
+}
+
+// Backend names a Diarizer implementation for Config.
+type Backend string
+
+const (
+	// HTTP posts the audio as base64 WAV in JSON to the diarizer service.
+	HTTP Backend = "http"
+	// Pipe streams the audio to a local program like the diarize.py of
+	// minibridge over stdin and reads the timespans back from its stdout.
+	Pipe Backend = "pipe"
+)
+
+type Config struct {
+	// Backend is the Diarizer used, HTTP if empty.
+	Backend Backend
+	// Endpoint is the URL the HTTP backend posts to.
+	Endpoint string
+	// Command is the program and arguments the Pipe backend runs.
+	Command []string
+
+	// Source is the type of the events whose spans are diarized, "activity"
+	// by default. With "transcription" the speakers come after the text.
+	Source string
+	// Context is how much of the track before the span is diarized along
+	// with it, so the same person is more likely to get the same label
+	// across spans. 30s by default.
+	Context time.Duration
+	// Timeout is how long a diarization can take, 30s by default.
+	Timeout time.Duration
+}
+
+// NewDiarizer returns the Diarizer of the configured backend.
+func NewDiarizer(config Config) (Diarizer, error) {
+	switch config.Backend {
+	case HTTP, "":
+		return &HTTPDiarizer{Endpoint: config.Endpoint}, nil
+	case Pipe:
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("diarize: pipe backend needs a command")
+		}
+		return &PipeDiarizer{Command: config.Command}, nil
+	}
+	return nil, fmt.Errorf("diarize: unknown backend %q", config.Backend)
+}
+
+// Speaker is the data of a "speaker" event, recorded over the part of the
+// source event's span someone spoke in.
+type Speaker struct {
+	// Source is the event the speaker was found in.
+	Source  tracks.ID `json:"source"`
+	Speaker string    `json:"speaker"`
+}
+
+type Agent struct {
+	Diarizer Diarizer
+	Source   string
+	Context  time.Duration
+	Timeout  time.Duration
+}
+
+// New returns an agent using the configured backend, it panics if the
+// backend is unknown.
+func New(config Config) *Agent {
+	d, err := NewDiarizer(config)
+	if err != nil {
+		panic(err)
+	}
+	return &Agent{
+		Diarizer: d,
+		Source:   config.Source,
+		Context:  config.Context,
+		Timeout:  config.Timeout,
+	}
+}
+
+func (a *Agent) AudioFormat() beep.Format {
+	return Format
+}
+
+func (a *Agent) Subscription() tracks.Filter {
+	source := a.Source
+	if source == "" {
+		source = "activity"
+	}
+	return tracks.Filter{Types: []string{source}}
+}
+
+// HandleEvent diarizes the span of the event along with the context before
+// it, and records a "speaker" event for each timespan within the span.
+func (a *Agent) HandleEvent(annot tracks.Event) {
+	track := annot.Track()
+	lookback := a.Context
+	if lookback == 0 {
+		lookback = 30 * time.Second
+	}
+	from := max(annot.Start-tracks.Timestamp(lookback), track.Start())
+	pcm, err := audio.StreamAll(tracks.AudioAs(track.Span(from, annot.End), Format))
+	if err != nil {
+		log.Println("diarize:", err)
+		return
+	}
+
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	timespans, err := a.Diarizer.Diarize(ctx, pcm)
+	cancel()
+	if err != nil {
+		log.Println("diarize:", err)
+		return
+	}
+	recordSpeakers(annot, from, timespans)
+}
+
+// recordSpeakers records the timespans, relative to from, that overlap the
+// span of the event, cut to the span.
+func recordSpeakers(e tracks.Event, from tracks.Timestamp, timespans []Timespan) {
+	at := func(seconds float32) tracks.Timestamp {
+		return from + tracks.Timestamp(float64(seconds)*float64(time.Second))
+	}
+	for _, ts := range timespans {
+		start := max(at(ts.Start), e.Start)
+		end := min(at(ts.End), e.End)
+		if end <= start {
+			continue
+		}
+		e.Track().Span(start, end).RecordEvent("speaker", &Speaker{
+			Source:  e.ID,
+			Speaker: ts.Speaker,
+		})
+	}
+}
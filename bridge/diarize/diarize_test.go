@@ -0,0 +1,163 @@
+package diarize
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gopxl/beep"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func init() {
+	// recorded by the vad agent, which the tests stand in for
+	tracks.RegisterEvent[any]("activity")
+}
+
+func ms(n int) tracks.Timestamp {
+	return tracks.Timestamp(time.Duration(n) * time.Millisecond)
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AudioData == nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&Response{Timespans: []Timespan{
+			{Start: 0, End: 0.5, Speaker: "SPEAKER_00"},
+			{Start: 0.5, End: 1, Speaker: fmt.Sprintf("%d bytes", len(*req.AudioData))},
+		}})
+	}))
+	defer server.Close()
+
+	d := &HTTPDiarizer{Endpoint: server.URL}
+	got, err := d.Diarize(context.Background(), make([]float32, 16000))
+	require.NoError(t, err)
+	// a header and 16 bit samples
+	assert.DeepEqual(t, got, []Timespan{
+		{Start: 0, End: 0.5, Speaker: "SPEAKER_00"},
+		{Start: 0.5, End: 1, Speaker: "32044 bytes"},
+	})
+
+	d.Endpoint = server.URL + "/missing"
+	_, err = d.Diarize(context.Background(), make([]float32, 10))
+	assert.ErrorContains(t, err, "404 Not Found")
+}
+
+func TestPipeHelper(t *testing.T) {
+	if os.Getenv("DIARIZE_PIPE_HELPER") == "" {
+		t.Skip("only run by the pipe tests")
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		var size int
+		if _, err := fmt.Fscanln(in, &size); err != nil {
+			os.Exit(0)
+		}
+		pcm := make([]float32, size/4)
+		if err := binary.Read(in, binary.LittleEndian, pcm); err != nil {
+			os.Exit(1)
+		}
+		if pcm[0] == -1 {
+			// hang to test cancellation
+			select {}
+		}
+		json.NewEncoder(os.Stdout).Encode([]Timespan{{
+			End:     float32(len(pcm)) / float32(Format.SampleRate),
+			Speaker: "SPEAKER_00",
+		}})
+	}
+}
+
+func TestPipe(t *testing.T) {
+	os.Setenv("DIARIZE_PIPE_HELPER", "1")
+	defer os.Unsetenv("DIARIZE_PIPE_HELPER")
+	d := &PipeDiarizer{Command: []string{os.Args[0], "-test.run=^TestPipeHelper$"}}
+	defer d.Close()
+
+	got, err := d.Diarize(context.Background(), make([]float32, 8000))
+	require.NoError(t, err)
+	assert.DeepEqual(t, got, []Timespan{{End: 0.5, Speaker: "SPEAKER_00"}})
+
+	// the program is restarted after a diarization is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = d.Diarize(ctx, []float32{-1})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	got, err = d.Diarize(context.Background(), make([]float32, 16000))
+	require.NoError(t, err)
+	assert.DeepEqual(t, got, []Timespan{{End: 1, Speaker: "SPEAKER_00"}})
+
+	_, err = NewDiarizer(Config{Backend: Pipe})
+	assert.ErrorContains(t, err, "needs a command")
+	_, err = NewDiarizer(Config{Backend: "nope"})
+	assert.ErrorContains(t, err, "unknown backend")
+}
+
+// fixedDiarizer returns the same timespans for any audio and keeps how much
+// audio it was given.
+type fixedDiarizer struct {
+	timespans []Timespan
+	samples   int
+}
+
+func (d *fixedDiarizer) Diarize(ctx context.Context, pcm []float32) ([]Timespan, error) {
+	d.samples = len(pcm)
+	return d.timespans, nil
+}
+
+func TestAgent(t *testing.T) {
+	d := &fixedDiarizer{timespans: []Timespan{
+		// before the activity, only there for context
+		{Start: 0, End: 0.8, Speaker: "SPEAKER_01"},
+		{Start: 0.8, End: 1.5, Speaker: "SPEAKER_00"},
+		{Start: 1.5, End: 2.5, Speaker: "SPEAKER_01"},
+	}}
+	session := tracks.NewSession()
+	session.Listen(&Agent{Diarizer: d, Context: time.Second})
+	track := session.NewTrackAt(ms(1000), Format)
+	track.AddAudio(beep.Silence(Format.SampleRate.N(4 * time.Second)))
+	e := track.Span(ms(3000), ms(4000)).RecordEvent("activity", nil)
+	session.Wait()
+
+	// a second of context before the activity
+	assert.Equal(t, d.samples, Format.SampleRate.N(2*time.Second))
+	speakers := track.Events("speaker")
+	assert.Equal(t, len(speakers), 2)
+	assert.Equal(t, speakers[0].Start, ms(3000))
+	assert.Equal(t, speakers[0].End, ms(3500))
+	assert.DeepEqual(t, speakers[0].Data, &Speaker{Source: e.ID, Speaker: "SPEAKER_00"})
+	assert.Equal(t, speakers[1].Start, ms(3500))
+	// cut to the activity
+	assert.Equal(t, speakers[1].End, ms(4000))
+	assert.DeepEqual(t, speakers[1].Data, &Speaker{Source: e.ID, Speaker: "SPEAKER_01"})
+
+	// the events are registered so the session loads again
+	b, err := cbor.Marshal(session)
+	assert.NilError(t, err)
+	loaded := &tracks.Session{}
+	assert.NilError(t, cbor.Unmarshal(b, loaded))
+	assert.DeepEqual(t, loaded.Track(track.ID).Events("speaker")[1].Data, speakers[1].Data)
+
+	// context doesn't reach back before the track
+	d.timespans = nil
+	track.Span(ms(1500), ms(2000)).RecordEvent("activity", nil)
+	session.Wait()
+	assert.Equal(t, d.samples, Format.SampleRate.N(time.Second))
+}
@@ -0,0 +1,42 @@
+package diarize
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/internal/backend"
+)
+
+// HTTPDiarizer posts the audio to the diarizer service in services/diarizer.
+type HTTPDiarizer struct {
+	Endpoint string
+	// Client is http.DefaultClient if nil.
+	Client *http.Client
+}
+
+type Request struct {
+	AudioData *[]byte `json:"audio_data,omitempty"`
+}
+
+type Response struct {
+	Timespans []Timespan `json:"timespans"`
+}
+
+func (d *HTTPDiarizer) Diarize(ctx context.Context, pcm []float32) ([]Timespan, error) {
+	b, err := audio.ToWav(pcm, Format.SampleRate.N(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	body, err := backend.PostJSON(ctx, d.Client, d.Endpoint, &Request{AudioData: &b})
+	if err != nil {
+		return nil, err
+	}
+	response := &Response{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	return response.Timespans, nil
+}
@@ -0,0 +1,44 @@
+package diarize
+
+import (
+	"context"
+	"sync"
+
+	"github.com/progrium/webrtc-sessions/bridge/internal/backend"
+)
+
+// PipeDiarizer runs a program like the diarize.py of minibridge and keeps it
+// running between diarizations, talking to it like backend.Pipe does with a
+// line with a JSON array of timespans back for each one.
+type PipeDiarizer struct {
+	Command []string
+
+	once sync.Once
+	p    *backend.Pipe
+}
+
+func (d *PipeDiarizer) pipe() *backend.Pipe {
+	d.once.Do(func() {
+		d.p = &backend.Pipe{Command: d.Command}
+	})
+	return d.p
+}
+
+// Start starts the program ahead of the first diarization, loading the
+// pipeline takes a while.
+func (d *PipeDiarizer) Start() error {
+	return d.pipe().Start()
+}
+
+func (d *PipeDiarizer) Diarize(ctx context.Context, pcm []float32) ([]Timespan, error) {
+	var timespans []Timespan
+	if err := d.pipe().Call(ctx, pcm, &timespans); err != nil {
+		return nil, err
+	}
+	return timespans, nil
+}
+
+// Close stops the program.
+func (d *PipeDiarizer) Close() error {
+	return d.pipe().Close()
+}
@@ -0,0 +1,161 @@
+// Package export writes out the audio of whole sessions, with the tracks
+// aligned by their start times.
+package export
+
+import (
+	"errors"
+	"io"
+
+	"github.com/gopxl/beep"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"gopkg.in/hraban/opus.v2"
+)
+
+var ErrNoAudio = errors.New("export: session has no audio")
+
+const (
+	// Opus always works at 48kHz internally
+	oggSampleRate = 48000
+	// 20ms, the usual Opus frame size
+	oggFrameSize = oggSampleRate / 50
+)
+
+// Span returns the span covering all the audio of a session, from the
+// session start to the end of its last track.
+func Span(sess *tracks.Session) *tracks.SessionSpan {
+	var end tracks.Timestamp
+	for _, t := range sess.Tracks() {
+		end = max(end, t.End())
+	}
+	return sess.Span(0, end)
+}
+
+// WAV writes the audio of the session as 16-bit WAV with one channel per
+// track, in the order the tracks started. Tracks are downmixed to mono and
+// padded with silence where they have no audio. The header only has the
+// length of the audio if w can seek.
+func WAV(w io.Writer, sess *tracks.Session) error {
+	span := Span(sess)
+	trks := span.Tracks()
+	if len(trks) == 0 {
+		return ErrNoAudio
+	}
+	streams := make([]beep.Streamer, len(trks))
+	for i, t := range trks {
+		streams[i] = span.TrackAudio(t)
+	}
+	ww, err := audio.NewWavWriter(w, audio.WavFormat{
+		SampleRate:   span.AudioFormat().SampleRate,
+		NumChannels:  len(trks),
+		SampleFormat: audio.Int16,
+	})
+	if err != nil {
+		return err
+	}
+	samples := make([][2]float64, 4096)
+	buf := make([]float64, len(trks)*len(samples))
+	channels := make([][]float64, len(trks))
+	for {
+		// the streams of a span all have the same length
+		var n int
+		for c, s := range streams {
+			n, err = fill(s, samples)
+			if err != nil {
+				return err
+			}
+			channels[c] = buf[c*len(samples) : c*len(samples)+n]
+			for i, sample := range samples[:n] {
+				channels[c][i] = (sample[0] + sample[1]) / 2
+			}
+		}
+		if n == 0 {
+			break
+		}
+		if err := ww.WriteChannels(channels...); err != nil {
+			return err
+		}
+	}
+	return ww.Close()
+}
+
+// Ogg writes the audio of all tracks of the session mixed down to stereo as
+// Ogg/Opus.
+func Ogg(w io.Writer, sess *tracks.Session) error {
+	span := Span(sess)
+	if len(span.Tracks()) == 0 {
+		return ErrNoAudio
+	}
+	var s beep.Streamer = span.Audio()
+	if rate := span.AudioFormat().SampleRate; rate != oggSampleRate {
+		s = audio.Resample(s, rate, oggSampleRate)
+	}
+
+	enc, err := opus.NewEncoder(oggSampleRate, 2, opus.AppAudio)
+	if err != nil {
+		return err
+	}
+	ogg, err := oggwriter.NewWith(w, oggSampleRate, 2)
+	if err != nil {
+		return err
+	}
+	samples := make([][2]float64, oggFrameSize)
+	pcm := make([]float32, 2*oggFrameSize)
+	packet := make([]byte, 4000)
+	for frame := uint32(0); ; frame++ {
+		n, err := fill(s, samples)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		for i := range samples {
+			if i >= n {
+				// Opus only takes whole frames, so pad the last one
+				samples[i] = [2]float64{}
+			}
+			pcm[2*i], pcm[2*i+1] = float32(samples[i][0]), float32(samples[i][1])
+		}
+		size, err := enc.EncodeFloat32(pcm, packet)
+		if err != nil {
+			return err
+		}
+		err = ogg.WriteRTP(&rtp.Packet{
+			Header:  oggHeader(frame),
+			Payload: packet[:size],
+		})
+		if err != nil {
+			return err
+		}
+		if n < len(samples) {
+			break
+		}
+	}
+	return ogg.Close()
+}
+
+// oggHeader is the RTP header of the nth frame. The sequence number wraps
+// after 65536 frames but the timestamp keeps counting, the writer works out
+// the granule positions from it.
+func oggHeader(frame uint32) rtp.Header {
+	return rtp.Header{
+		SequenceNumber: uint16(frame),
+		Timestamp:      frame * oggFrameSize,
+	}
+}
+
+// fill streams into samples until it's full or s ends.
+func fill(s beep.Streamer, samples [][2]float64) (int, error) {
+	var n int
+	for n < len(samples) {
+		m, ok := s.Stream(samples[n:])
+		n += m
+		if !ok {
+			return n, s.Err()
+		}
+	}
+	return n, nil
+}
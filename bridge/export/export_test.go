@@ -0,0 +1,57 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-audio/wav"
+	"github.com/gopxl/beep"
+	"github.com/gopxl/beep/generators"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestWAV(t *testing.T) {
+	format := beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2}
+	sess := tracks.NewSession()
+	first := sess.NewTrackAt(0, format)
+	tone, err := generators.SineTone(format.SampleRate, 100)
+	require.NoError(t, err)
+	first.AddAudio(beep.Take(1000, tone))
+	second := sess.NewTrackAt(tracks.Timestamp(500*time.Millisecond), format)
+	second.AddAudio(beep.Take(1000, tone))
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "session.wav"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, WAV(f, sess))
+
+	_, err = f.Seek(0, 0)
+	require.NoError(t, err)
+	dec := wav.NewDecoder(f)
+	buf, err := dec.FullPCMBuffer()
+	require.NoError(t, err)
+	assert.Equal(t, 2, buf.Format.NumChannels)
+	assert.Equal(t, 1000, buf.Format.SampleRate)
+	assert.Equal(t, 1500, buf.NumFrames())
+
+	// the second track is silent until it starts, the first after it ends
+	assert.Equal(t, 0, buf.Data[2*102+1])
+	assert.Assert(t, buf.Data[2*102] != 0)
+	assert.Equal(t, 0, buf.Data[2*1202])
+	assert.Assert(t, buf.Data[2*1202+1] != 0)
+
+	assert.Equal(t, ErrNoAudio, WAV(f, tracks.NewSession()))
+}
+
+func TestOggHeader(t *testing.T) {
+	// 65536 frames is about 22 minutes
+	before, after := oggHeader(1<<16-1), oggHeader(1<<16)
+	assert.Equal(t, before.SequenceNumber, uint16(1<<16-1))
+	assert.Equal(t, after.SequenceNumber, uint16(0))
+	assert.Equal(t, after.Timestamp-before.Timestamp, uint32(oggFrameSize))
+	assert.Equal(t, after.Timestamp, uint32(1<<16*oggFrameSize))
+}
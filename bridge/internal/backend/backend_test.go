@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+type result struct {
+	Samples int `json:"samples"`
+}
+
+// TestPipeHelper is the program the pipe test runs, it answers with the
+// number of samples it's given.
+func TestPipeHelper(t *testing.T) {
+	if os.Getenv("BACKEND_PIPE_HELPER") == "" {
+		t.Skip("only run by the pipe test")
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		var size int
+		if _, err := fmt.Fscanln(in, &size); err != nil {
+			os.Exit(0)
+		}
+		pcm := make([]float32, size/4)
+		if err := binary.Read(in, binary.LittleEndian, pcm); err != nil {
+			os.Exit(1)
+		}
+		if pcm[0] == -1 {
+			// hang to test cancellation
+			select {}
+		}
+		json.NewEncoder(os.Stdout).Encode(result{Samples: len(pcm)})
+	}
+}
+
+func TestPipe(t *testing.T) {
+	os.Setenv("BACKEND_PIPE_HELPER", "1")
+	defer os.Unsetenv("BACKEND_PIPE_HELPER")
+	p := &Pipe{Command: []string{os.Args[0], "-test.run=^TestPipeHelper$"}}
+	defer p.Close()
+
+	require.NoError(t, p.Start())
+	first := p.cmd
+	for _, n := range []int{16000, 800} {
+		var r result
+		require.NoError(t, p.Call(context.Background(), make([]float32, n), &r))
+		assert.Equal(t, r.Samples, n)
+	}
+	assert.Equal(t, p.cmd, first)
+
+	// the program is restarted after a call is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Call(ctx, []float32{-1}, &result{}), context.DeadlineExceeded)
+	assert.Assert(t, p.cmd == nil)
+	var r result
+	require.NoError(t, p.Call(context.Background(), make([]float32, 10), &r))
+	assert.Equal(t, r.Samples, 10)
+	assert.Assert(t, p.cmd != first)
+}
+
+func TestPostJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.Header.Get("Content-Type"), "application/json")
+		var req map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch req["status"] {
+		case "":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, "done")
+		case "busy":
+			http.Error(w, "busy", http.StatusTooManyRequests)
+		case "broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.Error(w, "bad", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	post := func(status string) ([]byte, error) {
+		return PostJSON(context.Background(), nil, server.URL, map[string]string{"status": status})
+	}
+
+	body, err := post("")
+	require.NoError(t, err)
+	assert.Equal(t, string(body), "done")
+
+	for status, temporary := range map[string]bool{"busy": true, "broken": true, "bad": false} {
+		_, err := post(status)
+		var statusErr *StatusError
+		require.True(t, errors.As(err, &statusErr), "%v", err)
+		assert.Equal(t, statusErr.Temporary(), temporary, status)
+		assert.ErrorContains(t, err, status)
+	}
+}
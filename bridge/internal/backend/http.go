@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// PostJSON posts v as JSON to the endpoint and returns the body of the
+// response, like Do.
+func PostJSON(ctx context.Context, client *http.Client, endpoint string, v any) ([]byte, error) {
+	payloadBytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return Do(client, req)
+}
+
+// Do sends the request with the client, http.DefaultClient if nil, and
+// returns the body of a successful response. Other responses are returned
+// as a *StatusError.
+func Do(client *http.Client, req *http.Request) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Status: resp.Status, StatusCode: resp.StatusCode, Body: body}
+	}
+	return body, nil
+}
+
+// StatusError is returned when a service answers with an error.
+type StatusError struct {
+	Status     string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// Temporary reports whether the request might work if it's tried again.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
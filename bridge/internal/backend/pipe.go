@@ -0,0 +1,124 @@
+// Package backend has what the agents share to talk to the programs and
+// services doing the actual work.
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Pipe runs a program like the scripts of minibridge and keeps it running
+// between calls. For each call it writes the size of the audio in bytes on a
+// line, then the samples as little endian float32, and reads the result back
+// as a line of JSON. Calls are one at a time. If the context is done while
+// waiting, the program is stopped and started again for the next one.
+type Pipe struct {
+	Command []string
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// Start starts the program ahead of the first call, for programs that take a
+// while to load.
+func (p *Pipe) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd != nil {
+		return nil
+	}
+	return p.start()
+}
+
+func (p *Pipe) start() error {
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd, p.in, p.out = cmd, in, bufio.NewReader(out)
+	return nil
+}
+
+// Call sends the audio to the program and decodes the line it answers with
+// into v.
+func (p *Pipe) Call(ctx context.Context, pcm []float32, v any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, pcm)
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if _, err := fmt.Fprintf(p.in, "%d\n", buf.Len()); err != nil {
+			done <- result{err: err}
+			return
+		}
+		if _, err := buf.WriteTo(p.in); err != nil {
+			done <- result{err: err}
+			return
+		}
+		line, err := p.out.ReadBytes('\n')
+		done <- result{line, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		p.stop()
+		<-done
+		return ctx.Err()
+	}
+	if r.err != nil {
+		p.stop()
+		return fmt.Errorf("%s: %w", p.Command[0], r.err)
+	}
+	return json.Unmarshal(r.line, v)
+}
+
+// Close stops the program.
+func (p *Pipe) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop()
+	return nil
+}
+
+func (p *Pipe) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.in.Close()
+	p.cmd.Process.Kill()
+	// it was killed so the error says nothing
+	p.cmd.Wait()
+	p.cmd = nil
+}
@@ -17,7 +17,7 @@ func fatal(err error) {
 }
 
 func main() {
-	url := "http://localhost:8000/v1/diarize"
+	url := "http://localhost:8093/v1/diarize"
 	audio, err := os.ReadFile("test.ogg")
 	fatal(err)
 	request := &DiarizeRequest{
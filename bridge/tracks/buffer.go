@@ -35,6 +35,14 @@ func (b *continuousBuffer) Len() int {
 	return b.audio.Len()
 }
 
+// Streamer returns the samples between from and to that are already in the
+// buffer, unlike StreamerFrom which waits for more.
+func (b *continuousBuffer) Streamer(from, to int) beep.Streamer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.audio.Streamer(from, to)
+}
+
 func (b *continuousBuffer) StreamerFrom(start int) beep.Streamer {
 	return beep.Iterate(func() beep.Streamer {
 		b.mu.Lock()
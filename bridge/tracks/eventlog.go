@@ -0,0 +1,154 @@
+package tracks
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// logRecord is one entry of an event log. The first event of a track that is
+// not in the snapshot yet is preceded by a record describing the track.
+type logRecord struct {
+	Track    ID
+	NewTrack *trackSnapshot `cbor:",omitempty"`
+	Event    *Event         `cbor:",omitempty"`
+}
+
+// eventLog is an append-only CBOR sequence of events recorded after the last
+// snapshot of a session.
+type eventLog struct {
+	filename string
+	f        *os.File
+	tracks   map[ID]bool // tracks in the snapshot or already in the log
+	count    int         // records since the snapshot
+	tolerant bool        // keep events of unknown types, see FileStore
+}
+
+func (l *eventLog) Append(t *Track, e Event) error {
+	if l.f == nil {
+		f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		l.f = f
+	}
+	var b []byte
+	if !l.tracks[t.ID] {
+		rec, err := snapshotEncoding.Marshal(logRecord{
+			Track: t.ID,
+			NewTrack: &trackSnapshot{
+				ID:     t.ID,
+				Start:  t.start,
+				Format: t.AudioFormat(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		b = append(b, rec...)
+	}
+	rec, err := snapshotEncoding.Marshal(logRecord{Track: t.ID, Event: &e})
+	if err != nil {
+		return err
+	}
+	b = append(b, rec...)
+	// a single write so a crash can only leave a torn record at the end
+	if _, err := l.f.Write(b); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.tracks[t.ID] = true
+	l.count++
+	return nil
+}
+
+// Replay applies the records in the log to s. A torn record at the end of the
+// log, left by a crash during Append, is discarded and truncated away so new
+// records can be appended after the last complete one. If s is nil the log is
+// only checked.
+func (l *eventLog) Replay(s *Session) error {
+	f, err := os.OpenFile(l.filename, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := cbor.NewDecoder(f)
+	for {
+		good := dec.NumBytesRead()
+		var raw cbor.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// anything that isn't a complete CBOR item is the torn tail
+			return f.Truncate(int64(good))
+		}
+		if s == nil {
+			l.count++
+			continue
+		}
+		rec, err := l.decode(raw)
+		if err != nil {
+			return err
+		}
+		l.apply(s, rec)
+	}
+}
+
+func (l *eventLog) decode(data []byte) (rec logRecord, err error) {
+	var raw struct {
+		logRecord
+		Event cbor.RawMessage `cbor:",omitempty"`
+	}
+	if err := cbor.Unmarshal(data, &raw); err != nil {
+		return rec, err
+	}
+	rec = raw.logRecord
+	if raw.Event != nil {
+		e, err := decodeEvent(raw.Event, l.tolerant)
+		if err != nil {
+			return rec, err
+		}
+		rec.Event = &e
+	}
+	return rec, nil
+}
+
+func (l *eventLog) apply(s *Session, rec logRecord) {
+	l.count++
+	l.tracks[rec.Track] = true
+	if rec.NewTrack != nil {
+		if s.Track(rec.Track) == nil {
+			t := trackFromSnapshot(rec.NewTrack)
+			t.Session = s
+			s.tracks.Store(t.ID, t)
+		}
+	}
+	if rec.Event == nil {
+		return
+	}
+	t := s.Track(rec.Track)
+	if t == nil {
+		return
+	}
+	e := *rec.Event
+	e.track = t
+	t.events.put(e)
+}
+
+func (l *eventLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -1,31 +1,282 @@
 package tracks
 
 import (
+	"math"
 	"reflect"
 	"sync"
 )
 
+// DefaultQueueSize is the number of undelivered events a handler can have
+// queued when it was added with Listen.
+const DefaultQueueSize = 256
+
+// OverflowPolicy decides what Emit does when a handler's queue is full.
+type OverflowPolicy int
+
+const (
+	// Block makes Emit wait until the handler has caught up. A handler that
+	// emits events itself can deadlock on its own full queue with this policy.
+	Block OverflowPolicy = iota
+	// DropOldest discards the oldest undelivered event to make room.
+	DropOldest
+)
+
+type QueueConfig struct {
+	Size   int // DefaultQueueSize if zero
+	Policy OverflowPolicy
+}
+
+// Filter selects the events a handler is subscribed to. Empty fields match
+// any event.
+type Filter struct {
+	Types        []string
+	ExcludeTypes []string
+	Track        ID
+	// From and To select events overlapping the time range. A zero To leaves
+	// the range open ended.
+	From, To Timestamp
+}
+
+func (f Filter) Match(e Event) bool {
+	if len(f.Types) > 0 && !contains(f.Types, e.Type) {
+		return false
+	}
+	if contains(f.ExcludeTypes, e.Type) {
+		return false
+	}
+	if f.Track != "" && (e.track == nil || e.track.ID != f.Track) {
+		return false
+	}
+	if f.From == 0 && f.To == 0 {
+		return true
+	}
+	to := f.To
+	if to == 0 {
+		to = math.MaxInt64
+	}
+	return spanOverlaps(f.From, to, e.Start, e.End)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A Subscriber is a Handler that declares which events it wants. Listen
+// uses its Subscription as the filter.
+type Subscriber interface {
+	Handler
+	Subscription() Filter
+}
+
+type QueueStats struct {
+	Handler   Handler
+	Depth     int // events waiting to be delivered
+	Delivered uint64
+	Dropped   uint64
+}
+
+// EventEmitter delivers emitted events to each handler in order on a
+// goroutine per handler, so a slow handler only holds up its own queue.
 type EventEmitter struct {
 	m sync.Map
+
+	pending int // events queued or being handled
+	idle    sync.Cond
+	mu      sync.Mutex
 }
 
 func (ee *EventEmitter) Listen(n Handler) {
-	ee.m.Store(reflect.ValueOf(n), n)
+	ee.ListenWith(n, QueueConfig{})
+}
+
+func (ee *EventEmitter) ListenWith(n Handler, config QueueConfig) {
+	var filter Filter
+	if s, ok := n.(Subscriber); ok {
+		filter = s.Subscription()
+	}
+	ee.SubscribeWith(n, filter, config)
 }
 
+// Subscribe adds a handler that only receives events matching the filter.
+// Events that don't match are never queued for it.
+func (ee *EventEmitter) Subscribe(n Handler, filter Filter) {
+	ee.SubscribeWith(n, filter, QueueConfig{})
+}
+
+func (ee *EventEmitter) SubscribeWith(n Handler, filter Filter, config QueueConfig) {
+	q := newQueue(n, filter, config, ee.done)
+	if old, loaded := ee.m.Swap(reflect.ValueOf(n), q); loaded {
+		old.(*queue).close()
+	}
+	go q.run()
+}
+
+// Unlisten removes the handler. Events still queued for it are discarded.
 func (ee *EventEmitter) Unlisten(n Handler) {
-	ee.m.Delete(reflect.ValueOf(n))
+	if q, loaded := ee.m.LoadAndDelete(reflect.ValueOf(n)); loaded {
+		q.(*queue).close()
+	}
 }
 
 func (ee *EventEmitter) Emit(e Event) {
 	ee.m.Range(func(k, v any) bool {
-		if h, ok := v.(Handler); ok {
-			go h.HandleEvent(e)
+		if q := v.(*queue); q.filter.Match(e) {
+			ee.mu.Lock()
+			ee.pending++
+			ee.mu.Unlock()
+			q.push(e)
 		}
 		return true
 	})
 }
 
+func (ee *EventEmitter) done(n int) {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+	ee.pending -= n
+	if ee.pending == 0 && ee.idle.L != nil {
+		ee.idle.Broadcast()
+	}
+}
+
+// Wait blocks until every emitted event has been handled, including events
+// emitted by the handlers in the meantime.
+func (ee *EventEmitter) Wait() {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+	if ee.idle.L == nil {
+		ee.idle.L = &ee.mu
+	}
+	for ee.pending > 0 {
+		ee.idle.Wait()
+	}
+}
+
+// Stats reports the state of the queue of every handler.
+func (ee *EventEmitter) Stats() []QueueStats {
+	var out []QueueStats
+	ee.m.Range(func(k, v any) bool {
+		out = append(out, v.(*queue).stats())
+		return true
+	})
+	return out
+}
+
 type HandlerFunc func(e Event)
 
 func (f HandlerFunc) HandleEvent(e Event) { f(e) }
+
+type queue struct {
+	handler Handler
+	filter  Filter
+	policy  OverflowPolicy
+	done    func(n int) // called as events are handled or discarded
+
+	events []Event // ring buffer of len(events) == size
+	head   int
+	len    int
+	closed bool
+
+	delivered uint64
+	dropped   uint64
+
+	mu       sync.Mutex
+	notEmpty sync.Cond
+	notFull  sync.Cond
+}
+
+func newQueue(h Handler, filter Filter, config QueueConfig, done func(int)) *queue {
+	if config.Size <= 0 {
+		config.Size = DefaultQueueSize
+	}
+	q := &queue{
+		handler: h,
+		filter:  filter,
+		policy:  config.Policy,
+		done:    done,
+		events:  make([]Event, config.Size),
+	}
+	q.notEmpty.L = &q.mu
+	q.notFull.L = &q.mu
+	return q
+}
+
+func (q *queue) push(e Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.len == len(q.events) && !q.closed {
+		if q.policy == DropOldest {
+			q.events[q.head] = Event{}
+			q.head = (q.head + 1) % len(q.events)
+			q.len--
+			q.dropped++
+			q.done(1)
+			break
+		}
+		q.notFull.Wait()
+	}
+	if q.closed {
+		q.done(1)
+		return
+	}
+	q.events[(q.head+q.len)%len(q.events)] = e
+	q.len++
+	q.notEmpty.Signal()
+}
+
+func (q *queue) pop() (e Event, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.len == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if q.closed {
+		return Event{}, false
+	}
+	e = q.events[q.head]
+	q.events[q.head] = Event{}
+	q.head = (q.head + 1) % len(q.events)
+	q.len--
+	q.notFull.Signal()
+	return e, true
+}
+
+func (q *queue) run() {
+	for {
+		e, ok := q.pop()
+		if !ok {
+			return
+		}
+		q.handler.HandleEvent(e)
+		q.mu.Lock()
+		q.delivered++
+		q.mu.Unlock()
+		q.done(1)
+	}
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.done(q.len)
+	q.len = 0
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+func (q *queue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Handler:   q.handler,
+		Depth:     q.len,
+		Delivered: q.delivered,
+		Dropped:   q.dropped,
+	}
+}
@@ -0,0 +1,160 @@
+package tracks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/gopxl/beep/generators"
+	"gotest.tools/assert"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEmitOrder(t *testing.T) {
+	var ee EventEmitter
+	got := make(chan Timestamp, 1000)
+	h := HandlerFunc(func(e Event) {
+		if e.Start%100 == 0 {
+			// a slow handler should still see events in order
+			time.Sleep(time.Millisecond)
+		}
+		got <- e.Start
+	})
+	ee.ListenWith(h, QueueConfig{Size: 10})
+	for i := 0; i < 1000; i++ {
+		ee.Emit(Event{EventMeta: EventMeta{Start: Timestamp(i)}})
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, Timestamp(i), <-got)
+	}
+	waitFor(t, func() bool { return ee.Stats()[0].Delivered == 1000 })
+	assert.Equal(t, uint64(0), ee.Stats()[0].Dropped)
+}
+
+func TestEmitDropOldest(t *testing.T) {
+	var ee EventEmitter
+	release := make(chan struct{})
+	got := make(chan Timestamp, 10)
+	h := HandlerFunc(func(e Event) {
+		<-release
+		got <- e.Start
+	})
+	ee.ListenWith(h, QueueConfig{Size: 2, Policy: DropOldest})
+
+	ee.Emit(Event{EventMeta: EventMeta{Start: 0}})
+	// wait for the handler to be holding the first event so the rest queue up
+	waitFor(t, func() bool { return ee.Stats()[0].Depth == 0 })
+	for i := 1; i <= 4; i++ {
+		ee.Emit(Event{EventMeta: EventMeta{Start: Timestamp(i)}})
+	}
+	stats := ee.Stats()[0]
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, uint64(2), stats.Dropped)
+
+	close(release)
+	assert.Equal(t, Timestamp(0), <-got)
+	assert.Equal(t, Timestamp(3), <-got)
+	assert.Equal(t, Timestamp(4), <-got)
+}
+
+func TestUnlisten(t *testing.T) {
+	var ee EventEmitter
+	got := make(chan Timestamp, 10)
+	h := HandlerFunc(func(e Event) {
+		got <- e.Start
+	})
+	ee.Listen(h)
+	ee.Emit(Event{EventMeta: EventMeta{Start: 1}})
+	assert.Equal(t, Timestamp(1), <-got)
+	ee.Unlisten(h)
+	ee.Emit(Event{EventMeta: EventMeta{Start: 2}})
+	assert.Equal(t, 0, len(ee.Stats()))
+	select {
+	case ts := <-got:
+		t.Fatalf("got event %v after Unlisten", ts)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFilter(t *testing.T) {
+	track := &Track{ID: "track-a"}
+	other := &Track{ID: "track-b"}
+	event := func(tr *Track, typ string, start, end Timestamp) Event {
+		return Event{EventMeta: EventMeta{Type: typ, Start: start, End: end}, track: tr}
+	}
+	for _, tt := range []struct {
+		name   string
+		filter Filter
+		event  Event
+		want   bool
+	}{
+		{"empty matches all", Filter{}, event(track, "text", 0, 10), true},
+		{"type", Filter{Types: []string{"text"}}, event(track, "text", 0, 10), true},
+		{"other type", Filter{Types: []string{"text"}}, event(track, "audio", 0, 10), false},
+		{"excluded type", Filter{ExcludeTypes: []string{"audio"}}, event(track, "audio", 0, 10), false},
+		{"track", Filter{Track: "track-a"}, event(track, "text", 0, 10), true},
+		{"other track", Filter{Track: "track-a"}, event(other, "text", 0, 10), false},
+		{"before range", Filter{From: 20, To: 30}, event(track, "text", 0, 10), false},
+		{"after range", Filter{From: 20, To: 30}, event(track, "text", 30, 40), false},
+		{"overlapping range", Filter{From: 20, To: 30}, event(track, "text", 15, 25), true},
+		{"open ended range", Filter{From: 20}, event(track, "text", 100, 110), true},
+		{"ending at from", Filter{From: 20, To: 30}, event(track, "text", 10, 20), false},
+		{"point at from", Filter{From: 20, To: 30}, event(track, "text", 20, 20), true},
+		{"point at to", Filter{From: 20, To: 30}, event(track, "text", 30, 30), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(tt.event))
+		})
+	}
+}
+
+type subscribedHandler struct {
+	got chan Event
+}
+
+func (h *subscribedHandler) HandleEvent(e Event) { h.got <- e }
+
+func (h *subscribedHandler) Subscription() Filter {
+	return Filter{Types: []string{"text"}}
+}
+
+func TestSubscribe(t *testing.T) {
+	session := &Session{}
+	track := session.NewTrackAt(0, beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2})
+
+	h := &subscribedHandler{got: make(chan Event, 10)}
+	session.Listen(h)
+	defer session.Unlisten(h)
+
+	type Note struct{ Text string }
+	RegisterEvent[Note]("note")
+	notes := make(chan Note, 10)
+	nh := SubscribeData(session, "note", Filter{Track: track.ID}, func(e Event, n Note) {
+		notes <- n
+	})
+	defer session.Unlisten(nh)
+
+	track.AddAudio(generators.Silence(10))
+	track.RecordEvent("note", Note{Text: "hello"})
+	track.RecordEvent("text", "foo")
+
+	assert.Equal(t, "foo", (<-h.got).Data)
+	assert.Equal(t, Note{Text: "hello"}, <-notes)
+	select {
+	case e := <-h.got:
+		t.Fatalf("unexpected %q event", e.Type)
+	case n := <-notes:
+		t.Fatalf("unexpected note %v", n)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
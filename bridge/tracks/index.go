@@ -0,0 +1,274 @@
+package tracks
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// eventIndex holds the events of a track. Live events, the ones that are
+// neither deleted nor superseded, are also kept in an interval tree per type
+// so time range queries don't have to look at the whole history. The zero
+// value is an empty index.
+type eventIndex struct {
+	byID       map[ID]Event
+	byType     map[string]*intervalTree
+	superseded map[ID]bool
+	mu         sync.RWMutex
+}
+
+func (idx *eventIndex) get(id ID) (Event, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	e, ok := idx.byID[id]
+	return e, ok
+}
+
+// put stores e, replacing any older version of it. Versions that aren't
+// newer than the stored one are ignored, like an update still in the log
+// after a compaction put a later version in the snapshot.
+func (idx *eventIndex) put(e Event) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if prev, ok := idx.byID[e.ID]; ok && e.Version <= prev.Version {
+		return
+	}
+	idx.store(e)
+}
+
+// update replaces the event with the given ID by what f returns, if there is
+// one.
+func (idx *eventIndex) update(id ID, f func(prev Event) Event) (prev, next Event, ok bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	prev, ok = idx.byID[id]
+	if !ok {
+		return Event{}, Event{}, false
+	}
+	next = f(prev)
+	idx.store(next)
+	return prev, next, true
+}
+
+func (idx *eventIndex) store(e Event) {
+	if idx.byID == nil {
+		idx.byID = make(map[ID]Event)
+		idx.byType = make(map[string]*intervalTree)
+		idx.superseded = make(map[ID]bool)
+	}
+	if prev, ok := idx.byID[e.ID]; ok {
+		idx.unindex(prev)
+	}
+	idx.byID[e.ID] = e
+	// superseding is permanent, even if a later version of e drops the link
+	for _, id := range e.Supersedes {
+		if old, ok := idx.byID[id]; ok && !idx.superseded[id] {
+			idx.unindex(old)
+		}
+		idx.superseded[id] = true
+	}
+	if !e.Deleted && !idx.superseded[e.ID] {
+		tree, ok := idx.byType[e.Type]
+		if !ok {
+			tree = &intervalTree{}
+			idx.byType[e.Type] = tree
+		}
+		tree.insert(e)
+	}
+}
+
+func (idx *eventIndex) unindex(e Event) {
+	if tree, ok := idx.byType[e.Type]; ok {
+		tree.delete(e)
+		if tree.root == nil {
+			delete(idx.byType, e.Type)
+		}
+	}
+}
+
+// all returns every event including deleted and superseded ones, sorted.
+func (idx *eventIndex) all() []Event {
+	idx.mu.RLock()
+	out := make([]Event, 0, len(idx.byID))
+	for _, e := range idx.byID {
+		out = append(out, e)
+	}
+	idx.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return eventLess(out[i], out[j])
+	})
+	return out
+}
+
+func (idx *eventIndex) types() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var out []string
+	for typ := range idx.byType {
+		out = append(out, typ)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// query returns the live events of a type matching q in order, and if match
+// isn't nil, also match.
+func (idx *eventIndex) query(typ string, q intervalQuery, match func(Event) bool) []Event {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	tree, ok := idx.byType[typ]
+	if !ok {
+		return nil
+	}
+	var out []Event
+	tree.root.visit(q, func(e Event) {
+		if match == nil || match(e) {
+			out = append(out, e)
+		}
+	})
+	return out
+}
+
+func eventLess(a, b Event) bool {
+	if a.Start != b.Start {
+		return a.Start < b.Start
+	}
+	if a.End != b.End {
+		return a.End < b.End
+	}
+	return a.ID < b.ID
+}
+
+// intervalQuery selects events by bounds on their start and end, all of them
+// inclusive. Half-open span rules are left to the match func of query.
+type intervalQuery struct {
+	startMin, startMax Timestamp
+	endMin, endMax     Timestamp
+}
+
+var everything = intervalQuery{
+	startMin: math.MinInt64, startMax: math.MaxInt64,
+	endMin: math.MinInt64, endMax: math.MaxInt64,
+}
+
+// overlapping narrows down to events that could overlap from-to.
+func overlapping(from, to Timestamp) intervalQuery {
+	q := everything
+	q.startMax = to
+	q.endMin = from
+	return q
+}
+
+// intervalTree is a treap ordered by eventLess where every node also tracks
+// the latest end in its subtree, so subtrees that end before a query can be
+// skipped.
+type intervalTree struct {
+	root *intervalNode
+}
+
+type intervalNode struct {
+	event       Event
+	priority    uint32
+	maxEnd      Timestamp
+	left, right *intervalNode
+}
+
+func (t *intervalTree) insert(e Event) {
+	t.root = t.root.insert(&intervalNode{event: e, priority: rand.Uint32(), maxEnd: e.End})
+}
+
+func (t *intervalTree) delete(e Event) {
+	t.root = t.root.delete(e)
+}
+
+func (n *intervalNode) update() {
+	n.maxEnd = n.event.End
+	if n.left != nil && n.left.maxEnd > n.maxEnd {
+		n.maxEnd = n.left.maxEnd
+	}
+	if n.right != nil && n.right.maxEnd > n.maxEnd {
+		n.maxEnd = n.right.maxEnd
+	}
+}
+
+func (n *intervalNode) rotateRight() *intervalNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.update()
+	l.update()
+	return l
+}
+
+func (n *intervalNode) rotateLeft() *intervalNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.update()
+	r.update()
+	return r
+}
+
+func (n *intervalNode) insert(node *intervalNode) *intervalNode {
+	if n == nil {
+		return node
+	}
+	if eventLess(node.event, n.event) {
+		n.left = n.left.insert(node)
+		if n.left.priority > n.priority {
+			return n.rotateRight()
+		}
+	} else {
+		n.right = n.right.insert(node)
+		if n.right.priority > n.priority {
+			return n.rotateLeft()
+		}
+	}
+	n.update()
+	return n
+}
+
+func (n *intervalNode) delete(e Event) *intervalNode {
+	if n == nil {
+		return nil
+	}
+	switch {
+	case e.ID == n.event.ID:
+		switch {
+		case n.left == nil:
+			return n.right
+		case n.right == nil:
+			return n.left
+		case n.left.priority > n.right.priority:
+			n = n.rotateRight()
+			n.right = n.right.delete(e)
+		default:
+			n = n.rotateLeft()
+			n.left = n.left.delete(e)
+		}
+	case eventLess(e, n.event):
+		n.left = n.left.delete(e)
+	default:
+		n.right = n.right.delete(e)
+	}
+	n.update()
+	return n
+}
+
+// visit calls f in order for the events in the subtree matching q.
+func (n *intervalNode) visit(q intervalQuery, f func(Event)) {
+	if n == nil || n.maxEnd < q.endMin {
+		return
+	}
+	if n.event.Start >= q.startMin {
+		n.left.visit(q, f)
+	}
+	if n.event.Start > q.startMax {
+		return
+	}
+	if n.event.Start >= q.startMin && n.event.End >= q.endMin && n.event.End <= q.endMax {
+		f(n.event)
+	}
+	n.right.visit(q, f)
+}
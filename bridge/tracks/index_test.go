@@ -0,0 +1,109 @@
+package tracks
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"gotest.tools/assert"
+)
+
+// trackWithEvents returns a track with n "text" events of random lengths
+// spread over an hour.
+func trackWithEvents(n int) *Track {
+	rng := rand.New(rand.NewSource(1))
+	track := (&Session{}).NewTrackAt(0, beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2})
+	for i := 0; i < n; i++ {
+		start := Timestamp(rng.Int63n(int64(time.Hour)))
+		end := start + Timestamp(rng.Int63n(int64(10*time.Second)))
+		track.Span(start, end).RecordEvent("text", "")
+	}
+	return track
+}
+
+func TestEventIndex(t *testing.T) {
+	track := trackWithEvents(2000)
+	all := track.Events("text")
+	assert.Equal(t, 2000, len(all))
+	assert.Assert(t, sort.SliceIsSorted(all, func(i, j int) bool {
+		return eventLess(all[i], all[j])
+	}))
+
+	// the tree should agree with looking at every event
+	brute := func(match func(Event) bool) []Event {
+		var out []Event
+		for _, e := range all {
+			if match(e) {
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		from := Timestamp(rng.Int63n(int64(time.Hour)))
+		to := from + Timestamp(rng.Int63n(int64(time.Minute)))
+		assert.DeepEqual(t, brute(func(e Event) bool {
+			return spanOverlaps(from, to, e.Start, e.End)
+		}), track.Span(from, to).Events("text"), eqopts)
+		assert.DeepEqual(t, brute(func(e Event) bool {
+			return spanContains(from, to, e.Start, e.End)
+		}), track.EventsWithin("text", from, to), eqopts)
+		assert.DeepEqual(t, brute(func(e Event) bool {
+			return spanOverlaps(e.Start, e.End, from, from)
+		}), track.EventsAt("text", from), eqopts)
+	}
+
+	// deleted and superseded events leave the index
+	assert.Assert(t, track.DeleteEvent(all[0].ID))
+	Supersede(track.Span(all[2].Start, all[2].End), "text", "", all[1].ID)
+	got := track.Events("text")
+	assert.Equal(t, 1999, len(got))
+	for _, e := range got {
+		assert.Assert(t, e.ID != all[0].ID && e.ID != all[1].ID)
+	}
+	// updates moving an event are reindexed
+	moved := all[3]
+	moved.Start, moved.End = Timestamp(2*time.Hour), Timestamp(2*time.Hour+time.Second)
+	assert.Assert(t, track.UpdateEvent(moved))
+	got = track.EventsAt("text", Timestamp(2*time.Hour))
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, moved.ID, got[0].ID)
+	assert.DeepEqual(t, []string{"text"}, track.EventTypes())
+}
+
+func BenchmarkEvents(b *testing.B) {
+	track := trackWithEvents(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		track.Events("text")
+	}
+}
+
+func BenchmarkSpanEvents(b *testing.B) {
+	track := trackWithEvents(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := Timestamp(i%3600) * Timestamp(time.Second)
+		track.Span(from, from+Timestamp(time.Minute)).Events("text")
+	}
+}
+
+func BenchmarkEventsAt(b *testing.B) {
+	track := trackWithEvents(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		track.EventsAt("text", Timestamp(i%3600)*Timestamp(time.Second))
+	}
+}
+
+func BenchmarkRecordEvent(b *testing.B) {
+	track := trackWithEvents(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := Timestamp(i%3600) * Timestamp(time.Second)
+		track.Span(from, from+Timestamp(time.Second)).RecordEvent("text", "")
+	}
+}
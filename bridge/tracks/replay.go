@@ -0,0 +1,107 @@
+package tracks
+
+import (
+	"context"
+	"time"
+)
+
+// Replay feeds the recorded audio of a session into a fresh session chunk by
+// chunk, emitting the same "audio" events a live session does. Agents
+// listening on the replay Session can be run over a fixed recording, for
+// example to tune them or compare them against each other.
+type Replay struct {
+	Source *Session
+	// Session receives the replayed audio. Its tracks have the same IDs and
+	// start times as the tracks of the source, but none of their events.
+	Session *Session
+	// Chunk is the length of audio added per event, 100ms if zero.
+	Chunk time.Duration
+	// Speed relative to real time, so 2 replays an hour of audio in half an
+	// hour. Zero replays as fast as the listeners keep up.
+	Speed float64
+}
+
+func NewReplay(src *Session) *Replay {
+	r := &Replay{
+		Source: src,
+		Session: &Session{
+			ID:    newID(),
+			Start: src.Start,
+		},
+		Chunk: 100 * time.Millisecond,
+		Speed: 1,
+	}
+	for _, t := range src.Tracks() {
+		r.Session.tracks.Store(t.ID, &Track{
+			ID:      t.ID,
+			Session: r.Session,
+			start:   t.start,
+			audio:   newContinuousBuffer(t.AudioFormat()),
+		})
+	}
+	return r
+}
+
+// Run replays all the source audio, interleaving the tracks by time, and
+// closes the tracks once it has all been added. Call Session.Wait to also
+// wait for the listeners to handle it.
+func (r *Replay) Run(ctx context.Context) error {
+	srcTracks := r.Source.Tracks()
+	if len(srcTracks) == 0 {
+		return nil
+	}
+	from, to := srcTracks[0].Start(), srcTracks[0].End()
+	for _, t := range srcTracks[1:] {
+		if t.Start() < from {
+			from = t.Start()
+		}
+		if t.End() > to {
+			to = t.End()
+		}
+	}
+
+	chunk := r.Chunk
+	if chunk <= 0 {
+		chunk = 100 * time.Millisecond
+	}
+	began := time.Now()
+	for pos := from; pos < to; {
+		pos += Timestamp(chunk)
+		if pos > to {
+			pos = to
+		}
+		if r.Speed > 0 {
+			due := began.Add(time.Duration(float64(pos-from) / r.Speed))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, src := range srcTracks {
+			r.replayUntil(src, pos)
+		}
+	}
+	r.Session.Close()
+	return nil
+}
+
+// replayUntil adds the audio of src up to pos that hasn't been replayed yet.
+func (r *Replay) replayUntil(src *Track, pos Timestamp) {
+	if pos <= src.start {
+		return
+	}
+	dst := r.Session.Track(src.ID)
+	format := src.AudioFormat()
+	done := dst.audio.Len()
+	until := format.SampleRate.N(time.Duration(pos - src.start))
+	if n := src.audio.Len(); until > n {
+		until = n
+	}
+	if until <= done {
+		return
+	}
+	dst.AddAudio(src.audio.Streamer(done, until))
+}
@@ -0,0 +1,131 @@
+package tracks
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestReplay(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	src := NewSession()
+	first := src.NewTrackAt(0, format)
+	first.AddAudio(beep.Take(format.SampleRate.N(1*time.Second), audioGenerator(t)))
+	first.RecordEvent("text", "not replayed")
+	second := src.NewTrackAt(Timestamp(500*time.Millisecond), format)
+	second.AddAudio(beep.Take(format.SampleRate.N(1*time.Second), audioGenerator(t)))
+
+	replay := NewReplay(src)
+	replay.Speed = 0
+
+	var mu sync.Mutex
+	var events []Event
+	replay.Session.Subscribe(HandlerFunc(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}), Filter{Types: []string{"audio"}})
+
+	require.NoError(t, replay.Run(context.Background()))
+	replay.Session.Wait()
+
+	// every chunk of a track should follow on from the previous one
+	ends := map[ID]Timestamp{
+		first.ID:  first.Start(),
+		second.ID: second.Start(),
+	}
+	for _, e := range events {
+		assert.Equal(t, ends[e.Track().ID], e.Start)
+		assert.Assert(t, e.End-e.Start <= Timestamp(100*time.Millisecond))
+		ends[e.Track().ID] = e.End
+	}
+	assert.Equal(t, first.End(), ends[first.ID])
+	assert.Equal(t, second.End(), ends[second.ID])
+
+	for _, src := range []*Track{first, second} {
+		dst := replay.Session.Track(src.ID)
+		assert.Equal(t, src.Start(), dst.Start())
+		assert.Equal(t, src.End(), dst.End())
+		assertEqualAudio(t, format, src.Span(src.Start(), src.End()).Audio(), dst.Span(dst.Start(), dst.End()).Audio())
+		// recorded events aren't replayed, the track is only closed
+		assert.DeepEqual(t, []string{"track-end"}, dst.EventTypes())
+		assert.Equal(t, dst.Events("track-end")[0].Start, dst.End())
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	src := NewSession()
+	track := src.NewTrackAt(0, format)
+	track.AddAudio(beep.Take(format.SampleRate.N(1*time.Second), audioGenerator(t)))
+
+	replay := NewReplay(src)
+	replay.Speed = 10
+	began := time.Now()
+	require.NoError(t, replay.Run(context.Background()))
+	assert.Assert(t, time.Since(began) >= 100*time.Millisecond, "a second of audio at 10x should take at least 100ms")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, NewReplay(src).Run(ctx))
+}
+
+func TestReplaySave(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	store := NewFileStore(t.TempDir())
+	src := NewSession()
+	track := src.NewTrackAt(0, format)
+	track.AddAudio(beep.Take(format.SampleRate.N(1*time.Second), audioGenerator(t)))
+	require.NoError(t, store.SaveSession(src))
+	loaded, err := store.LoadSession(src.ID)
+	require.NoError(t, err)
+
+	// saved by the store that loaded the source, like replay -save does
+	replay := NewReplay(loaded)
+	replay.Speed = 0
+	require.NoError(t, replay.Run(context.Background()))
+	replay.Session.Wait()
+	require.NoError(t, store.SaveSession(replay.Session))
+
+	saved, err := NewFileStore(store.Dir).LoadSession(replay.Session.ID)
+	require.NoError(t, err)
+	dst := saved.Track(track.ID)
+	assert.Equal(t, Timestamp(time.Second), dst.End())
+	assertEqualAudio(t, format, track.Span(0, track.End()).Audio(), dst.Span(0, dst.End()).Audio())
+}
+
+func TestReplayZeroChunk(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	src := NewSession()
+	track := src.NewTrackAt(0, format)
+	track.AddAudio(beep.Take(format.SampleRate.N(1*time.Second), audioGenerator(t)))
+
+	replay := NewReplay(src)
+	replay.Speed = 0
+	replay.Chunk = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, replay.Run(ctx))
+	assert.Equal(t, replay.Session.Track(track.ID).End(), track.End())
+}
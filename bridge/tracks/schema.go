@@ -0,0 +1,151 @@
+package tracks
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var (
+	eventTypes   = map[string]reflect.Type{}
+	eventTypesMu sync.RWMutex
+)
+
+func init() {
+	// recorded by Track.Close
+	RegisterEvent[any]("track-end")
+}
+
+// RegisterEvent sets the type the data of events of the given type is
+// decoded as. Events without data can be registered as any. Registering a
+// type again as something else panics, since events recorded as one would
+// be decoded as the other.
+func RegisterEvent[T any](name string) {
+	// TODO(Go 1.22) can use reflect.TypeFor[T]()
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	eventTypesMu.Lock()
+	defer eventTypesMu.Unlock()
+	if registered, ok := eventTypes[name]; ok && registered != typ {
+		panic(fmt.Sprintf("tracks: event type %q is already registered as %v", name, registered))
+	}
+	eventTypes[name] = typ
+}
+
+func eventType(name string) (reflect.Type, bool) {
+	eventTypesMu.RLock()
+	defer eventTypesMu.RUnlock()
+	typ, ok := eventTypes[name]
+	return typ, ok
+}
+
+// EventSchema is a registered event type.
+type EventSchema struct {
+	Type string
+	// Data is the Go type of the event data.
+	Data reflect.Type
+}
+
+// Shape describes the data the way Go would declare it, with the fields of
+// structs spelled out, like
+//
+//	*struct { Text string `json:"text"`; Words []struct { ... } }
+//
+// Types already being described, like the element of a recursive struct,
+// are referred to by name.
+func (s EventSchema) Shape() string {
+	return shape(s.Data, map[reflect.Type]bool{})
+}
+
+// EventSchemas returns the registered event types sorted by name.
+func EventSchemas() []EventSchema {
+	eventTypesMu.RLock()
+	defer eventTypesMu.RUnlock()
+	var out []EventSchema
+	for name, typ := range eventTypes {
+		out = append(out, EventSchema{Type: name, Data: typ})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+func shape(t reflect.Type, seen map[reflect.Type]bool) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return "*" + shape(t.Elem(), seen)
+	case reflect.Slice:
+		return "[]" + shape(t.Elem(), seen)
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), shape(t.Elem(), seen))
+	case reflect.Map:
+		return fmt.Sprintf("map[%s]%s", shape(t.Key(), seen), shape(t.Elem(), seen))
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "any"
+		}
+		return t.String()
+	case reflect.Struct:
+		if seen[t] {
+			return t.String()
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			field := f.Name + " " + shape(f.Type, seen)
+			if f.Anonymous {
+				field = shape(f.Type, seen)
+			}
+			if f.Tag != "" {
+				field += fmt.Sprintf(" `%s`", f.Tag)
+			}
+			fields = append(fields, field)
+		}
+		if len(fields) == 0 {
+			// like time.Time, only its own encoding says what it looks like
+			return t.String()
+		}
+		return "struct { " + strings.Join(fields, "; ") + " }"
+	}
+	return t.Kind().String()
+}
+
+// ErrUnknownEventType is returned decoding an event of a type that isn't
+// registered.
+var ErrUnknownEventType = errors.New("unknown event type")
+
+// decodeEvent decodes an event with its data as the registered type. If
+// tolerant, events of unknown types are kept with their data as the
+// cbor.RawMessage it was encoded as, which encodes back the same.
+func decodeEvent(data []byte, tolerant bool) (Event, error) {
+	type EventRawData struct {
+		EventMeta
+		Data cbor.RawMessage
+	}
+	var eraw EventRawData
+	if err := cbor.Unmarshal(data, &eraw); err != nil {
+		return Event{}, err
+	}
+	typ, ok := eventType(eraw.Type)
+	if !ok {
+		if !tolerant {
+			return Event{}, fmt.Errorf("%w %q", ErrUnknownEventType, eraw.Type)
+		}
+		return Event{EventMeta: eraw.EventMeta, Data: eraw.Data}, nil
+	}
+	value := reflect.New(typ)
+	if err := cbor.Unmarshal(eraw.Data, value.Interface()); err != nil {
+		return Event{}, err
+	}
+	return Event{EventMeta: eraw.EventMeta, Data: reflect.Indirect(value).Interface()}, nil
+}
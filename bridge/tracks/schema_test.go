@@ -0,0 +1,37 @@
+package tracks
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+type schemaNode struct {
+	Name     string `json:"name"`
+	Children []*schemaNode
+	hidden   int
+}
+
+func TestEventSchemas(t *testing.T) {
+	RegisterEvent[*schemaNode]("schema-node")
+
+	shapes := map[string]string{}
+	for _, s := range EventSchemas() {
+		shapes[s.Type] = s.Shape()
+	}
+	assert.Equal(t, "any", shapes["track-end"])
+	assert.Equal(t, "string", shapes["text"])
+	assert.Equal(t, "*struct { Name string `json:\"name\"`; Children []*tracks.schemaNode }", shapes["schema-node"])
+
+	// the same type again is fine, another one isn't
+	RegisterEvent[*schemaNode]("schema-node")
+	assert.Assert(t, panics(func() { RegisterEvent[schemaNode]("schema-node") }))
+}
+
+func panics(f func()) (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+	f()
+	return
+}
@@ -0,0 +1,100 @@
+package tracks
+
+import (
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+)
+
+// Spans are half-open, a span from 10 to 20 covers 10 but not 20, so
+// adjacent spans like 0-10 and 10-20 never overlap. A span with no length is
+// a point in time, covered by the spans it falls in, which also lets point
+// events like a word boundary at 10 belong to the span from 10 to 20 but not
+// the one from 0 to 10.
+
+// Overlaps reports whether the spans share any time.
+func Overlaps(a, b Span) bool {
+	return spanOverlaps(a.Start(), a.End(), b.Start(), b.End())
+}
+
+// Contains reports whether all of b falls within a.
+func Contains(a, b Span) bool {
+	return spanContains(a.Start(), a.End(), b.Start(), b.End())
+}
+
+// Intersect returns the time a and b share as a span of a's track, and false
+// if they don't overlap.
+func Intersect(a, b Span) (Span, bool) {
+	if !Overlaps(a, b) {
+		return nil, false
+	}
+	return a.Track().Span(max(a.Start(), b.Start()), min(a.End(), b.End())), true
+}
+
+// Union returns the smallest span of a's track covering both a and b,
+// including any gap between them.
+func Union(a, b Span) Span {
+	return a.Track().Span(min(a.Start(), b.Start()), max(a.End(), b.End()))
+}
+
+func spanOverlaps(aStart, aEnd, bStart, bEnd Timestamp) bool {
+	switch {
+	case aStart == aEnd && bStart == bEnd:
+		return aStart == bStart
+	case aStart == aEnd:
+		return bStart <= aStart && aStart < bEnd
+	case bStart == bEnd:
+		return aStart <= bStart && bStart < aEnd
+	}
+	return aStart < bEnd && bStart < aEnd
+}
+
+func spanContains(aStart, aEnd, bStart, bEnd Timestamp) bool {
+	if bStart == bEnd {
+		return spanOverlaps(aStart, aEnd, bStart, bEnd)
+	}
+	return aStart <= bStart && bEnd <= aEnd
+}
+
+// AudioAs returns the audio of the span converted to the given format, for
+// agents that need a particular format regardless of what the track was
+// recorded in. Resampling reads a little of the track on either side of the
+// span so spans converted one after another join up smoothly.
+func AudioAs(span Span, format beep.Format) beep.Streamer {
+	track := span.Track()
+	from := track.AudioFormat()
+	if from.SampleRate == format.SampleRate {
+		return audio.Convert(span.Audio(), from, format)
+	}
+	margin := Timestamp(audio.ResampleMargin(from.SampleRate, format.SampleRate))
+	start := max(span.Start()-margin, track.Start())
+	end := min(span.End()+margin, track.End())
+	if end < span.End() {
+		end = span.End()
+	}
+	s := audio.Convert(track.Span(start, end).Audio(), from, format)
+	skip := format.SampleRate.N(time.Duration(span.Start() - start))
+	return beep.Take(format.SampleRate.N(span.Length()), &skipStreamer{s: s, skip: skip})
+}
+
+// skipStreamer drops the first samples of a stream.
+type skipStreamer struct {
+	s    beep.Streamer
+	skip int
+}
+
+func (s *skipStreamer) Stream(samples [][2]float64) (int, bool) {
+	for s.skip > 0 {
+		n, ok := s.s.Stream(samples[:min(s.skip, len(samples))])
+		s.skip -= n
+		if !ok {
+			return 0, false
+		}
+	}
+	return s.s.Stream(samples)
+}
+
+func (s *skipStreamer) Err() error {
+	return s.s.Err()
+}
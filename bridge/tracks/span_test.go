@@ -0,0 +1,121 @@
+package tracks
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/gopxl/beep/generators"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestSpanAlgebra(t *testing.T) {
+	track := (&Session{}).NewTrackAt(0, beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2})
+	span := func(from, to Timestamp) Span {
+		return track.Span(from, to)
+	}
+	for _, tt := range []struct {
+		name      string
+		a, b      Span
+		overlaps  bool
+		contains  bool
+		intersect [2]Timestamp
+		union     [2]Timestamp
+	}{
+		{"disjoint", span(0, 10), span(20, 30), false, false, [2]Timestamp{}, [2]Timestamp{0, 30}},
+		{"adjacent", span(0, 10), span(10, 20), false, false, [2]Timestamp{}, [2]Timestamp{0, 20}},
+		{"overlapping", span(0, 10), span(5, 15), true, false, [2]Timestamp{5, 10}, [2]Timestamp{0, 15}},
+		{"containing", span(0, 20), span(5, 15), true, true, [2]Timestamp{5, 15}, [2]Timestamp{0, 20}},
+		{"contained", span(5, 15), span(0, 20), true, false, [2]Timestamp{5, 15}, [2]Timestamp{0, 20}},
+		{"equal", span(0, 10), span(0, 10), true, true, [2]Timestamp{0, 10}, [2]Timestamp{0, 10}},
+		{"sharing start", span(0, 10), span(0, 5), true, true, [2]Timestamp{0, 5}, [2]Timestamp{0, 10}},
+		{"sharing end", span(0, 10), span(5, 10), true, true, [2]Timestamp{5, 10}, [2]Timestamp{0, 10}},
+		{"point at start", span(0, 10), span(0, 0), true, true, [2]Timestamp{0, 0}, [2]Timestamp{0, 10}},
+		{"point inside", span(0, 10), span(5, 5), true, true, [2]Timestamp{5, 5}, [2]Timestamp{0, 10}},
+		{"point at end", span(0, 10), span(10, 10), false, false, [2]Timestamp{}, [2]Timestamp{0, 10}},
+		{"point outside", span(0, 10), span(20, 20), false, false, [2]Timestamp{}, [2]Timestamp{0, 20}},
+		{"span around point", span(5, 5), span(0, 10), true, false, [2]Timestamp{5, 5}, [2]Timestamp{0, 10}},
+		{"same point", span(5, 5), span(5, 5), true, true, [2]Timestamp{5, 5}, [2]Timestamp{5, 5}},
+		{"different points", span(5, 5), span(6, 6), false, false, [2]Timestamp{}, [2]Timestamp{5, 6}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.overlaps, Overlaps(tt.a, tt.b))
+			assert.Equal(t, tt.overlaps, Overlaps(tt.b, tt.a), "Overlaps should be symmetric")
+			assert.Equal(t, tt.contains, Contains(tt.a, tt.b))
+
+			in, ok := Intersect(tt.a, tt.b)
+			assert.Equal(t, tt.overlaps, ok)
+			if ok {
+				assert.Equal(t, tt.intersect, [2]Timestamp{in.Start(), in.End()})
+				assert.Equal(t, track, in.Track())
+			}
+			un := Union(tt.a, tt.b)
+			assert.Equal(t, tt.union, [2]Timestamp{un.Start(), un.End()})
+		})
+	}
+}
+
+func TestSpanEvents(t *testing.T) {
+	RegisterEvent[string]("word")
+	track := (&Session{}).NewTrackAt(0, beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2})
+	track.Span(0, 10).RecordEvent("text", "first")
+	track.Span(10, 20).RecordEvent("text", "second")
+	track.Span(10, 10).RecordEvent("word", "boundary")
+
+	texts := func(events []Event) []any {
+		var out []any
+		for _, e := range events {
+			out = append(out, e.Data)
+		}
+		return out
+	}
+	for _, tt := range []struct {
+		name  string
+		span  Span
+		types []string
+		text  []any
+	}{
+		{"first half", track.Span(0, 10), []string{"text"}, []any{"first"}},
+		{"second half", track.Span(10, 20), []string{"text", "word"}, []any{"second"}},
+		{"across", track.Span(5, 15), []string{"text", "word"}, []any{"first", "second"}},
+		{"point", track.Span(10, 10), []string{"text", "word"}, []any{"second"}},
+		{"after", track.Span(20, 30), nil, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.DeepEqual(t, tt.types, tt.span.EventTypes())
+			assert.DeepEqual(t, tt.text, texts(tt.span.Events("text")))
+		})
+	}
+	assert.DeepEqual(t, []any{"second"}, texts(track.EventsAt("text", 10)))
+	assert.DeepEqual(t, []any{"boundary"}, texts(track.EventsWithin("word", 10, 20)))
+	assert.DeepEqual(t, []any(nil), texts(track.EventsWithin("word", 0, 10)))
+}
+
+func TestAudioAs(t *testing.T) {
+	format := beep.Format{SampleRate: 48000, NumChannels: 2, Precision: 2}
+	want := beep.Format{SampleRate: 16000, NumChannels: 1, Precision: 2}
+	track := (&Session{}).NewTrackAt(0, format)
+	tone, err := generators.SineTone(format.SampleRate, 440)
+	require.NoError(t, err)
+	track.AddAudio(beep.Take(format.SampleRate.N(time.Second), tone))
+
+	whole := beep.NewBuffer(want)
+	whole.Append(AudioAs(track, want))
+	assert.Equal(t, want.SampleRate.N(time.Second), whole.Len())
+
+	// converting 100ms at a time should give the same audio
+	chunked := beep.NewBuffer(want)
+	for start := Timestamp(0); start < track.End(); start += Timestamp(100 * time.Millisecond) {
+		chunked.Append(AudioAs(track.Span(start, start+Timestamp(100*time.Millisecond)), want))
+	}
+	assert.Equal(t, whole.Len(), chunked.Len())
+	a := make([][2]float64, whole.Len())
+	b := make([][2]float64, chunked.Len())
+	whole.Streamer(0, whole.Len()).Stream(a)
+	chunked.Streamer(0, chunked.Len()).Stream(b)
+	for i := range a {
+		assert.Assert(t, math.Abs(a[i][0]-b[i][0]) < 1e-3, "sample %d: %v != %v", i, a[i][0], b[i][0])
+	}
+}
@@ -0,0 +1,323 @@
+package tracks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gopxl/beep"
+)
+
+// Store persists sessions along with the audio of their tracks.
+type Store interface {
+	// SaveSession writes a full snapshot of the session.
+	SaveSession(s *Session) error
+	// AppendEvent records a single new or updated event of a session that
+	// has been saved before, without rewriting the snapshot.
+	AppendEvent(e Event) error
+	LoadSession(id ID) (*Session, error)
+	Sessions() ([]ID, error)
+}
+
+// FileStore is a Store keeping each session in its own directory:
+//
+//	<Dir>/<session>/session           CBOR snapshot of the session
+//	<Dir>/<session>/events            CBOR sequence of events since the snapshot
+//	<Dir>/<session>/track-<track>.pcm raw audio in the track's format
+//
+// Track audio only ever grows, so saving a session appends the samples added
+// since the last save instead of rewriting the whole recording. Events are
+// appended to the log and compacted into the snapshot every CompactAfter
+// events or whenever the session is saved.
+//
+// Loading a session with events of a type that isn't registered fails unless
+// Tolerant is set, then their data is kept as cbor.RawMessage and saved again
+// as it was.
+//
+// NewFileStore sets CompactAfter to 1000, a FileStore with only Dir set works
+// too but doesn't compact on its own.
+type FileStore struct {
+	Dir          string
+	CompactAfter int
+	Tolerant     bool
+
+	written map[trackKey]int // samples already on disk per track
+	logs    map[ID]*eventLog // open event logs per session
+	mu      sync.Mutex
+}
+
+var _ Store = (*FileStore)(nil)
+
+// trackKey identifies a track in the store. Track IDs alone aren't enough,
+// a replay has the same track IDs as the session it replays.
+type trackKey struct {
+	Session, Track ID
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{
+		Dir:          dir,
+		CompactAfter: 1000,
+		written:      make(map[trackKey]int),
+		logs:         make(map[ID]*eventLog),
+	}
+}
+
+// lock locks the store, making its maps first if it wasn't made by
+// NewFileStore.
+func (st *FileStore) lock() {
+	st.mu.Lock()
+	if st.written == nil {
+		st.written = make(map[trackKey]int)
+		st.logs = make(map[ID]*eventLog)
+	}
+}
+
+func (st *FileStore) sessionDir(id ID) string {
+	return filepath.Join(st.Dir, string(id))
+}
+
+func (st *FileStore) trackFile(sess, track ID) string {
+	return filepath.Join(st.sessionDir(sess), fmt.Sprintf("track-%s.pcm", track))
+}
+
+func (st *FileStore) logFile(id ID) string {
+	return filepath.Join(st.sessionDir(id), "events")
+}
+
+func (st *FileStore) Sessions() (ids []ID, err error) {
+	dir, err := os.ReadDir(st.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range dir {
+		if fi.IsDir() {
+			ids = append(ids, ID(fi.Name()))
+		}
+	}
+	return
+}
+
+func (st *FileStore) snapshotFile(id ID) string {
+	return filepath.Join(st.sessionDir(id), "session")
+}
+
+func (st *FileStore) SaveSession(s *Session) error {
+	st.lock()
+	defer st.mu.Unlock()
+	return st.compact(s)
+}
+
+// compact writes a new snapshot of the session and starts a fresh event log,
+// since the snapshot includes everything the old log did.
+func (st *FileStore) compact(s *Session) error {
+	if err := os.MkdirAll(st.sessionDir(s.ID), 0744); err != nil {
+		return err
+	}
+	snap := s.snapshot()
+	for _, ts := range snap.Tracks {
+		if err := st.appendAudio(s.ID, s.Track(ts.ID)); err != nil {
+			return err
+		}
+	}
+	b, err := snapshotEncoding.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(st.snapshotFile(s.ID), b); err != nil {
+		return err
+	}
+	// a crash before the old log is removed is harmless, replaying it on top
+	// of the new snapshot stores the same events again
+	if l, ok := st.logs[s.ID]; ok {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(st.logFile(s.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l := &eventLog{filename: st.logFile(s.ID), tracks: make(map[ID]bool)}
+	for _, ts := range snap.Tracks {
+		l.tracks[ts.ID] = true
+	}
+	st.logs[s.ID] = l
+	return nil
+}
+
+func (st *FileStore) AppendEvent(e Event) error {
+	t := e.Track()
+	s := t.Session
+	st.lock()
+	defer st.mu.Unlock()
+	l, ok := st.logs[s.ID]
+	if !ok {
+		if _, err := os.Stat(st.snapshotFile(s.ID)); err == nil {
+			// saved by an earlier store, the log may already have records
+			l = &eventLog{filename: st.logFile(s.ID), tracks: make(map[ID]bool)}
+			if err := l.Replay(nil); err != nil {
+				return err
+			}
+			st.logs[s.ID] = l
+		} else {
+			// nothing to append to yet, the snapshot will have this event
+			return st.compact(s)
+		}
+	}
+	if err := st.appendAudio(s.ID, t); err != nil {
+		return err
+	}
+	if err := l.Append(t, e); err != nil {
+		return err
+	}
+	if st.CompactAfter > 0 && l.count >= st.CompactAfter {
+		return st.compact(s)
+	}
+	return nil
+}
+
+func (st *FileStore) appendAudio(sess ID, t *Track) error {
+	filename := st.trackFile(sess, t.ID)
+	format := t.AudioFormat()
+	key := trackKey{sess, t.ID}
+	from, ok := st.written[key]
+	if !ok {
+		// first time seeing this track, pick up after whatever is on disk
+		fi, err := os.Stat(filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			from = int(fi.Size()) / format.Width()
+			// drop a partial frame so appended samples stay aligned
+			if err := os.Truncate(filename, int64(from*format.Width())); err != nil {
+				return err
+			}
+		}
+	}
+	to := t.audio.Len()
+	if to <= from {
+		return nil
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := writePCM(w, format, t.audio.Streamer(from, to)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	st.written[key] = to
+	return nil
+}
+
+func (st *FileStore) LoadSession(id ID) (*Session, error) {
+	b, err := os.ReadFile(st.snapshotFile(id))
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if err := s.unmarshal(b, st.Tolerant); err != nil {
+		return nil, err
+	}
+	st.lock()
+	defer st.mu.Unlock()
+	l := &eventLog{filename: st.logFile(id), tracks: make(map[ID]bool), tolerant: st.Tolerant}
+	if err := l.Replay(s); err != nil {
+		return nil, err
+	}
+	st.logs[id] = l
+	for _, t := range s.Tracks() {
+		f, err := os.Open(st.trackFile(id, t.ID))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pcm := &pcmStreamer{r: bufio.NewReader(f), format: t.AudioFormat()}
+		t.audio.Append(pcm)
+		f.Close()
+		if pcm.err != nil {
+			return nil, pcm.err
+		}
+		st.written[trackKey{id, t.ID}] = t.audio.Len()
+	}
+	return s, nil
+}
+
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func writePCM(w io.Writer, format beep.Format, s beep.Streamer) error {
+	var samples [512][2]float64
+	buf := make([]byte, len(samples)*format.Width())
+	for {
+		n, ok := s.Stream(samples[:])
+		if !ok {
+			return s.Err()
+		}
+		p := buf
+		for _, sample := range samples[:n] {
+			p = p[format.EncodeSigned(p, sample):]
+		}
+		if _, err := w.Write(buf[:n*format.Width()]); err != nil {
+			return err
+		}
+	}
+}
+
+// pcmStreamer decodes raw signed PCM written by writePCM. A trailing partial
+// frame, like one left behind by a crash, is ignored.
+type pcmStreamer struct {
+	r      io.Reader
+	format beep.Format
+	err    error
+}
+
+func (p *pcmStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	frame := make([]byte, p.format.Width())
+	for i := range samples {
+		if _, err := io.ReadFull(p.r, frame); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				p.err = err
+			}
+			return i, i > 0
+		}
+		samples[i], _ = p.format.DecodeSigned(frame)
+	}
+	return len(samples), true
+}
+
+func (p *pcmStreamer) Err() error {
+	return p.err
+}
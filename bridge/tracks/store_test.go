@@ -0,0 +1,181 @@
+package tracks
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gopxl/beep"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	store := NewFileStore(t.TempDir())
+
+	session := NewSession()
+	track := session.NewTrackAt(0, format)
+	gen := audioGenerator(t)
+	track.AddAudio(beep.Take(format.SampleRate.N(1*time.Second), gen))
+	track.RecordEvent("text", "foo-one")
+	require.NoError(t, store.SaveSession(session))
+
+	// only the new audio should be appended on the next save
+	track.AddAudio(beep.Take(format.SampleRate.N(1*time.Second), gen))
+	track.Span(Timestamp(5*time.Millisecond), Timestamp(10*time.Millisecond)).RecordEvent("text", "foo-two")
+	require.NoError(t, store.SaveSession(session))
+
+	ids, err := store.Sessions()
+	require.NoError(t, err)
+	assert.DeepEqual(t, []ID{session.ID}, ids)
+
+	// load with a fresh store like a restarted process would
+	loaded, err := NewFileStore(store.Dir).LoadSession(session.ID)
+	require.NoError(t, err)
+	assert.DeepEqual(t, session.snapshot(), loaded.snapshot(), eqopts)
+
+	loadedTrack := loaded.Track(track.ID)
+	assert.Equal(t, Timestamp(2*time.Second), loadedTrack.End())
+	fullSamples := format.SampleRate.N(2 * time.Second)
+	assertEqualAudio(t, format, beep.Take(fullSamples, audioGenerator(t)), loadedTrack.Span(0, loadedTrack.End()).Audio())
+}
+
+func TestFileStoreLiteral(t *testing.T) {
+	format := beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2}
+	store := &FileStore{Dir: t.TempDir()}
+	session := NewSession()
+	track := session.NewTrackAt(0, format)
+	track.AddAudio(beep.Silence(1000))
+	require.NoError(t, store.SaveSession(session))
+	require.NoError(t, (&FileStore{Dir: store.Dir}).AppendEvent(track.RecordEvent("text", "foo")))
+
+	loaded, err := (&FileStore{Dir: store.Dir}).LoadSession(session.ID)
+	require.NoError(t, err)
+	assert.DeepEqual(t, session.snapshot(), loaded.snapshot(), eqopts)
+}
+
+func TestEventLog(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	store := NewFileStore(t.TempDir())
+
+	session := NewSession()
+	track := session.NewTrackAt(0, format)
+	require.NoError(t, store.SaveSession(session))
+
+	require.NoError(t, store.AppendEvent(track.RecordEvent("text", "foo-one")))
+	// tracks created after the snapshot are added by the log too
+	track2 := session.NewTrackAt(Timestamp(time.Second), format)
+	require.NoError(t, store.AppendEvent(track2.RecordEvent("text", "foo-two")))
+
+	loaded, err := NewFileStore(store.Dir).LoadSession(session.ID)
+	require.NoError(t, err)
+	assert.DeepEqual(t, session.snapshot(), loaded.snapshot(), eqopts)
+
+	// simulate a crash halfway through writing a record
+	logFile := store.logFile(session.ID)
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xa3, 0x65, 'T', 'r'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	store = NewFileStore(store.Dir)
+	loaded, err = store.LoadSession(session.ID)
+	require.NoError(t, err)
+	assert.DeepEqual(t, session.snapshot(), loaded.snapshot(), eqopts)
+
+	// appending after recovery should still produce a readable log
+	require.NoError(t, store.AppendEvent(loaded.Track(track.ID).RecordEvent("text", "foo-three")))
+	reloaded, err := NewFileStore(store.Dir).LoadSession(session.ID)
+	require.NoError(t, err)
+	assert.DeepEqual(t, loaded.snapshot(), reloaded.snapshot(), eqopts)
+
+	// compaction folds the log into the snapshot
+	store.CompactAfter = 1
+	require.NoError(t, store.AppendEvent(loaded.Track(track.ID).RecordEvent("text", "foo-four")))
+	_, err = os.Stat(logFile)
+	assert.Assert(t, os.IsNotExist(err))
+	reloaded, err = NewFileStore(store.Dir).LoadSession(session.ID)
+	require.NoError(t, err)
+	assert.DeepEqual(t, loaded.snapshot(), reloaded.snapshot(), eqopts)
+}
+
+func TestTolerantLoad(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	store := NewFileStore(t.TempDir())
+
+	// events of a type that isn't registered, like from an agent the loading
+	// process doesn't have, in both the snapshot and the log
+	session := NewSession()
+	track := session.NewTrackAt(0, format)
+	track.RecordEvent("unregistered", map[string]int{"snapshot": 1})
+	require.NoError(t, store.SaveSession(session))
+	require.NoError(t, store.AppendEvent(track.RecordEvent("unregistered", map[string]int{"log": 2})))
+	require.NoError(t, store.AppendEvent(track.RecordEvent("text", "foo-one")))
+
+	_, err := NewFileStore(store.Dir).LoadSession(session.ID)
+	require.ErrorIs(t, err, ErrUnknownEventType)
+
+	tolerant := NewFileStore(store.Dir)
+	tolerant.Tolerant = true
+	loaded, err := tolerant.LoadSession(session.ID)
+	require.NoError(t, err)
+	var data []any
+	for _, e := range loaded.Track(track.ID).Events("unregistered") {
+		data = append(data, e.Data)
+	}
+	snapshot, _ := cbor.Marshal(map[string]int{"snapshot": 1})
+	log, _ := cbor.Marshal(map[string]int{"log": 2})
+	assert.DeepEqual(t, []any{cbor.RawMessage(snapshot), cbor.RawMessage(log)}, data)
+	assert.Equal(t, "foo-one", loaded.Track(track.ID).Events("text")[0].Data)
+
+	// saving again keeps the data as it was
+	require.NoError(t, tolerant.SaveSession(loaded))
+	reloaded, err := tolerant.LoadSession(session.ID)
+	require.NoError(t, err)
+	assert.DeepEqual(t, loaded.snapshot(), reloaded.snapshot(), eqopts)
+}
+
+func TestEventLogVersions(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	store := NewFileStore(t.TempDir())
+	session := NewSession()
+	track := session.NewTrackAt(0, format)
+	e := track.RecordEvent("text", "draft")
+	require.NoError(t, store.SaveSession(session))
+
+	e.Data = "edited"
+	assert.Assert(t, track.UpdateEvent(e))
+	stale, _ := track.Event(e.ID)
+	assert.Assert(t, track.DeleteEvent(e.ID))
+	// the compaction snapshot has the deleted version
+	require.NoError(t, store.SaveSession(session))
+	// then an update queued before it is appended
+	require.NoError(t, store.AppendEvent(stale))
+
+	loaded, err := NewFileStore(store.Dir).LoadSession(session.ID)
+	require.NoError(t, err)
+	got, ok := loaded.Track(track.ID).Event(e.ID)
+	assert.Assert(t, ok)
+	assert.Equal(t, got.Version, 2)
+	assert.Assert(t, got.Deleted)
+	assert.Equal(t, len(loaded.Track(track.ID).Events("text")), 0)
+}
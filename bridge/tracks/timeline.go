@@ -0,0 +1,140 @@
+package tracks
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+)
+
+// SessionSpan is a span of time across all the tracks of a session, for
+// treating a session as a single timeline. Unlike a Span it doesn't belong to
+// a track, so events can't be recorded on it.
+type SessionSpan struct {
+	Session    *Session
+	start, end Timestamp
+}
+
+func (s *Session) Span(from, to Timestamp) *SessionSpan {
+	return &SessionSpan{Session: s, start: from, end: to}
+}
+
+func (s *SessionSpan) Span(from, to Timestamp) *SessionSpan {
+	return s.Session.Span(from, to)
+}
+
+func (s *SessionSpan) Start() Timestamp {
+	return s.start
+}
+
+func (s *SessionSpan) End() Timestamp {
+	return s.end
+}
+
+func (s *SessionSpan) Length() time.Duration {
+	return time.Duration(s.end - s.start)
+}
+
+// Tracks returns the tracks with audio in the span, ordered by start.
+func (s *SessionSpan) Tracks() []*Track {
+	var out []*Track
+	for _, t := range s.Session.Tracks() {
+		if spanOverlaps(s.start, s.end, t.Start(), t.End()) {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].start != out[j].start {
+			return out[i].start < out[j].start
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// EventTypes returns the types of the events in the span on any track.
+func (s *SessionSpan) EventTypes() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, t := range s.Session.Tracks() {
+		for _, typ := range t.Span(s.start, s.end).EventTypes() {
+			if !seen[typ] {
+				seen[typ] = true
+				out = append(out, typ)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Events returns the events of a type overlapping the span on all tracks,
+// merged into one ordered list. Event.Track tells which track they are from.
+func (s *SessionSpan) Events(typ string) []Event {
+	var out []Event
+	for _, t := range s.Session.Tracks() {
+		out = append(out, t.Span(s.start, s.end).Events(typ)...)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return eventLess(out[i], out[j])
+	})
+	return out
+}
+
+// AudioFormat returns the format of Audio, the highest sample rate, channel
+// count and precision of the tracks so mixing them down loses nothing.
+func (s *SessionSpan) AudioFormat() beep.Format {
+	var format beep.Format
+	for _, t := range s.Session.Tracks() {
+		f := t.AudioFormat()
+		format.SampleRate = max(format.SampleRate, f.SampleRate)
+		format.NumChannels = max(format.NumChannels, f.NumChannels)
+		format.Precision = max(format.Precision, f.Precision)
+	}
+	return format
+}
+
+// Audio mixes the audio of all tracks over the span down into one stream in
+// AudioFormat. Tracks are padded with silence where they have no audio, so the
+// stream always has the full length of the span. Loud overlapping speech can
+// clip since the tracks are summed as they are.
+func (s *SessionSpan) Audio() beep.Streamer {
+	format := s.AudioFormat()
+	n := format.SampleRate.N(s.Length())
+	var streams []beep.Streamer
+	for _, t := range s.Tracks() {
+		streams = append(streams, t.paddedAudio(s.start, s.end, format.SampleRate))
+	}
+	if len(streams) == 0 {
+		return beep.Silence(n)
+	}
+	return beep.Take(n, beep.Mix(streams...))
+}
+
+// TrackAudio returns the audio of one track over the span in AudioFormat,
+// padded with silence like Audio, for keeping tracks apart but aligned.
+func (s *SessionSpan) TrackAudio(t *Track) beep.Streamer {
+	return t.paddedAudio(s.start, s.end, s.AudioFormat().SampleRate)
+}
+
+// paddedAudio returns the audio of the track from from to to at the given
+// sample rate, with silence wherever the track has no audio. It only
+// includes audio already added to the track.
+func (t *Track) paddedAudio(from, to Timestamp, rate beep.SampleRate) beep.Streamer {
+	own := t.AudioFormat().SampleRate
+	total := own.N(time.Duration(to - from))
+	lead := min(max(own.N(time.Duration(t.start-from)), 0), total)
+	begin := max(own.N(time.Duration(from-t.start)), 0)
+	end := min(own.N(time.Duration(to-t.start)), t.audio.Len())
+
+	var s beep.Streamer = beep.Silence(lead)
+	if end > begin {
+		s = beep.Seq(s, t.audio.Streamer(begin, end))
+	}
+	if rate != own {
+		s = audio.Resample(s, own, rate)
+	}
+	// resampling can come up a few samples short
+	return beep.Take(rate.N(time.Duration(to-from)), beep.Seq(s, beep.Silence(-1)))
+}
@@ -0,0 +1,63 @@
+package tracks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"gotest.tools/assert"
+)
+
+func constantAudio(v float64, n int) beep.Streamer {
+	return beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		if n == 0 {
+			return 0, false
+		}
+		m := min(n, len(samples))
+		for i := range samples[:m] {
+			samples[i] = [2]float64{v, v}
+		}
+		n -= m
+		return m, true
+	})
+}
+
+func TestSessionSpan(t *testing.T) {
+	format := beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2}
+	ms := func(n int) Timestamp { return Timestamp(time.Duration(n) * time.Millisecond) }
+
+	session := &Session{}
+	a := session.NewTrackAt(0, format)
+	a.AddAudio(constantAudio(0.25, 1000))
+	b := session.NewTrackAt(ms(500), format)
+	b.AddAudio(constantAudio(0.5, 1000))
+
+	a.Span(ms(100), ms(200)).RecordEvent("text", "a1")
+	b.Span(ms(600), ms(700)).RecordEvent("text", "b1")
+	a.Span(ms(800), ms(900)).RecordEvent("text", "a2")
+	b.Span(ms(1400), ms(1500)).RecordEvent("text", "b2")
+
+	span := session.Span(ms(150), ms(1450))
+	var got []any
+	for _, e := range span.Events("text") {
+		got = append(got, e.Data)
+	}
+	assert.DeepEqual(t, []any{"a1", "b1", "a2", "b2"}, got)
+	assert.DeepEqual(t, []string{"text"}, span.EventTypes())
+	tracks := session.Span(ms(1000), ms(2000)).Tracks()
+	assert.Equal(t, 1, len(tracks))
+	assert.Equal(t, b, tracks[0])
+
+	// a alone, both mixed, b alone, then silence past the end of both
+	span = session.Span(ms(250), ms(1750))
+	assert.Equal(t, format, span.AudioFormat())
+	buf := beep.NewBuffer(span.AudioFormat())
+	buf.Append(span.Audio())
+	assert.Equal(t, 1500, buf.Len())
+	samples := make([][2]float64, buf.Len())
+	n, _ := buf.Streamer(0, buf.Len()).Stream(samples)
+	assert.Equal(t, 1500, n)
+	for i, want := range map[int]float64{0: 0.25, 249: 0.25, 250: 0.75, 749: 0.75, 750: 0.5, 1249: 0.5, 1250: 0, 1499: 0} {
+		assert.Assert(t, samples[i][0] > want-0.001 && samples[i][0] < want+0.001, "sample %d is %v, want %v", i, samples[i][0], want)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -31,6 +32,13 @@ type Handler interface {
 	HandleEvent(Event)
 }
 
+// AudioConsumer is implemented by handlers that need audio in a particular
+// format, like a model trained on 16kHz mono. They read it with AudioAs
+// whatever format the tracks are recorded in.
+type AudioConsumer interface {
+	AudioFormat() beep.Format
+}
+
 func newID() ID {
 	return ID(xid.New().String())
 }
@@ -39,12 +47,20 @@ type EventMeta struct {
 	Start, End Timestamp
 	Type       string
 	ID         ID
+	// Version is incremented every time the event is updated or deleted.
+	Version    int  `cbor:",omitempty"`
+	Supersedes []ID `cbor:",omitempty"`
+	// Deleted events are kept so the deletion is saved along with the rest.
+	Deleted bool `cbor:",omitempty"`
 }
 
 type Event struct {
 	EventMeta
-	Data  any
-	track *Track
+	Data any
+	// Previous is the event before the change on events emitted by
+	// UpdateEvent and DeleteEvent.
+	Previous *Event `cbor:"-"`
+	track    *Track
 }
 
 func (e Event) Track() *Track {
@@ -56,24 +72,11 @@ func (e Event) Span() Span {
 }
 
 func (e *Event) UnmarshalCBOR(data []byte) error {
-	type EventRawData struct {
-		EventMeta
-		Data cbor.RawMessage
-	}
-	var eraw EventRawData
-	if err := cbor.Unmarshal(data, &eraw); err != nil {
-		return err
-	}
-	typ, ok := eventTypes[eraw.Type]
-	if !ok {
-		return fmt.Errorf("unknown event type %q", eraw.Type)
-	}
-	value := reflect.New(typ)
-	if err := cbor.Unmarshal(eraw.Data, value.Interface()); err != nil {
+	evt, err := decodeEvent(data, false)
+	if err != nil {
 		return err
 	}
-	e.EventMeta = eraw.EventMeta
-	e.Data = reflect.Indirect(value).Interface()
+	*e = evt
 	return nil
 }
 
@@ -107,6 +110,22 @@ func (s *Session) NewTrackAt(start Timestamp, format beep.Format) *Track {
 	return t
 }
 
+// Track returns the track with the given ID or nil if there isn't one.
+func (s *Session) Track(id ID) *Track {
+	t, ok := s.tracks.Load(id)
+	if !ok {
+		return nil
+	}
+	return t.(*Track)
+}
+
+// Close closes all the tracks of the session.
+func (s *Session) Close() {
+	for _, t := range s.Tracks() {
+		t.Close()
+	}
+}
+
 func (s *Session) Tracks() []*Track {
 	var out []*Track
 	s.tracks.Range(func(key, value any) bool {
@@ -137,19 +156,44 @@ func (s *Session) snapshot() *sessionSnapshot {
 	return snap
 }
 
+// snapshots keep the full precision of the session start time, the default
+// encoding of whole unix seconds would lose it
+var snapshotEncoding, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
 func (s *Session) MarshalCBOR() ([]byte, error) {
-	return cbor.Marshal(s.snapshot())
+	return snapshotEncoding.Marshal(s.snapshot())
 }
 
 func (s *Session) UnmarshalCBOR(data []byte) error {
-	var s2 sessionSnapshot
+	return s.unmarshal(data, false)
+}
+
+// unmarshal decodes a snapshot, if tolerant events of unknown types are kept
+// with their data as cbor.RawMessage.
+func (s *Session) unmarshal(data []byte, tolerant bool) error {
+	// the events are decoded separately so they can be decoded tolerantly
+	var s2 struct {
+		sessionSnapshot
+		Tracks []*struct {
+			trackSnapshot
+			Events []cbor.RawMessage
+		}
+	}
 	if err := cbor.Unmarshal(data, &s2); err != nil {
 		return err
 	}
 	s.ID = s2.ID
 	s.Start = s2.Start
-	for _, ts := range s2.Tracks {
-		t := trackFromSnapshot(ts)
+	for _, raw := range s2.Tracks {
+		ts := raw.trackSnapshot
+		for _, data := range raw.Events {
+			e, err := decodeEvent(data, tolerant)
+			if err != nil {
+				return err
+			}
+			ts.Events = append(ts.Events, e)
+		}
+		t := trackFromSnapshot(&ts)
 		t.Session = s
 		s.tracks.Store(t.ID, t)
 	}
@@ -161,80 +205,114 @@ type Track struct {
 	Session *Session
 	start   Timestamp
 	audio   *continuousBuffer
-	events  sync.Map
+	events  eventIndex
+	closed  atomic.Bool
 }
 
 var _ Span = (*Track)(nil)
 
+// Close records a "track-end" event at the end of the track, telling agents
+// there's no more audio coming so they can finish up and drop any state they
+// keep for it. Closing it again does nothing.
+func (t *Track) Close() {
+	if !t.closed.CompareAndSwap(false, true) || len(t.Events("track-end")) > 0 {
+		return
+	}
+	t.Span(t.End(), t.End()).RecordEvent("track-end", nil)
+}
+
 func (t *Track) RecordEvent(typ string, data any) Event {
-	return t.record(typ, t, data)
+	return t.record(typ, t, data, nil)
+}
+
+func (t *Track) Supersede(typ string, data any, ids ...ID) Event {
+	return t.record(typ, t, data, ids)
 }
 
-func (t *Track) record(typ string, span Span, data any) Event {
+func (t *Track) record(typ string, span Span, data any, supersedes []ID) Event {
 	e := Event{
 		EventMeta: EventMeta{
-			ID:    newID(),
-			Start: span.Start(),
-			End:   span.End(),
-			Type:  typ,
+			ID:         newID(),
+			Start:      span.Start(),
+			End:        span.End(),
+			Type:       typ,
+			Supersedes: supersedes,
 		},
 		Data:  data,
 		track: t,
 	}
-	t.events.Store(e.ID, e)
+	t.events.put(e)
 	t.Session.Emit(e)
 	return e
 }
 
+// Event returns the event with the given ID, including deleted and
+// superseded events.
+func (t *Track) Event(id ID) (Event, bool) {
+	return t.events.get(id)
+}
+
+// UpdateEvent replaces the stored event with the same ID as evt as a new
+// version of it. It returns false without changing anything if there is no
+// such event.
 func (t *Track) UpdateEvent(evt Event) bool {
-	// this is a copy so it won't affect the caller, but make sure it's pointing
-	// to this track
-	evt.track = t
-	_, loaded := t.events.Swap(evt.ID, evt)
-	// XXX if event was not there before, should we still add it, or skip?
-	t.Session.Emit(evt)
-	return loaded
+	// evt is a copy so changing it won't affect the caller
+	return t.change(evt.ID, func(prev Event) Event {
+		return evt
+	})
 }
 
-func (t *Track) EventTypes() []string {
-	seen := map[string]bool{}
-	var out []string
-	t.rangeEvents(func(e Event) bool {
-		if seen[e.Type] {
-			return true
-		}
-		seen[e.Type] = true
-		out = append(out, e.Type)
-		return true
+// DeleteEvent marks the event as deleted, removing it from Events.
+func (t *Track) DeleteEvent(id ID) bool {
+	return t.change(id, func(prev Event) Event {
+		prev.Deleted = true
+		return prev
 	})
-	sort.Strings(out)
-	return out
 }
 
-func (t *Track) rangeEvents(f func(evt Event) bool) {
-	t.events.Range(func(key, value any) bool {
-		return f(value.(Event))
+func (t *Track) change(id ID, f func(prev Event) Event) bool {
+	prev, evt, ok := t.events.update(id, func(prev Event) Event {
+		evt := f(prev)
+		evt.ID = id
+		evt.Version = prev.Version + 1
+		evt.Previous = nil
+		// make sure it's pointing to this track
+		evt.track = t
+		return evt
 	})
+	if !ok {
+		return false
+	}
+	evt.Previous = &prev
+	t.Session.Emit(evt)
+	return true
+}
+
+func (t *Track) EventTypes() []string {
+	return t.events.types()
 }
 
 func (t *Track) Events(typ string) []Event {
-	var out []Event
-	t.rangeEvents(func(e Event) bool {
-		if e.Type == typ {
-			out = append(out, e)
-		}
-		return true
+	return t.events.query(typ, everything, nil)
+}
+
+// EventsAt returns the events of a type covering the given point in time.
+func (t *Track) EventsAt(typ string, ts Timestamp) []Event {
+	return t.events.query(typ, overlapping(ts, ts), func(e Event) bool {
+		return spanOverlaps(e.Start, e.End, ts, ts)
 	})
-	sort.Slice(out, func(i, j int) bool {
-		if out[i].Start < out[j].Start {
-			return true
-		}
-		if out[i].Start > out[j].Start {
-			return false
-		}
-		return out[i].End < out[j].End
+}
+
+// EventsWithin returns the events of a type that fall entirely within from
+// and to.
+func (t *Track) EventsWithin(typ string, from, to Timestamp) []Event {
+	q := intervalQuery{
+		startMin: from, startMax: to,
+		endMin: from, endMax: to,
+	}
+	return t.events.query(typ, q, func(e Event) bool {
+		return spanContains(from, to, e.Start, e.End)
 	})
-	return out
 }
 
 func (t *Track) Audio() beep.Streamer {
@@ -298,20 +376,7 @@ func (t *Track) snapshot() *trackSnapshot {
 		Start:  t.start,
 		Format: t.audio.Format(),
 	}
-	t.rangeEvents(func(e Event) bool {
-		data.Events = append(data.Events, e)
-		return true
-	})
-	sort.Slice(data.Events, func(i, j int) bool {
-		ei, ej := data.Events[i], data.Events[j]
-		if ei.Start < ej.Start {
-			return true
-		}
-		if ei.Start > ej.Start {
-			return false
-		}
-		return ei.End < ej.End
-	})
+	data.Events = t.events.all()
 	return &data
 }
 
@@ -323,7 +388,7 @@ func trackFromSnapshot(tm *trackSnapshot) *Track {
 	}
 	for _, e := range tm.Events {
 		e.track = t
-		t.events.Store(e.ID, e)
+		t.events.put(e)
 	}
 	return t
 }
@@ -336,25 +401,33 @@ type filteredSpan struct {
 var _ Span = (*filteredSpan)(nil)
 
 func (s *filteredSpan) RecordEvent(typ string, data any) Event {
-	return s.Track().record(typ, s, data)
+	return s.Track().record(typ, s, data, nil)
 }
 
-func (s *filteredSpan) EventTypes() []string {
-	// TODO should it return all types for the Track, or only ones found within this span?
-	return s.Track().EventTypes()
+// Supersede records an event over the span replacing the given ones, which
+// are no longer returned by Events, like a final result replacing drafts.
+func Supersede(span Span, typ string, data any, ids ...ID) Event {
+	return span.Track().record(typ, span, data, ids)
 }
 
-func (s *filteredSpan) Events(typ string) []Event {
-	var out []Event
-	for _, a := range s.track.Events(typ) {
-		if a.End < s.start || a.Start > s.end {
-			continue
+// EventTypes returns the types of the events overlapping the span.
+func (s *filteredSpan) EventTypes() []string {
+	var out []string
+	for _, typ := range s.track.EventTypes() {
+		if len(s.Events(typ)) > 0 {
+			out = append(out, typ)
 		}
-		out = append(out, a)
 	}
 	return out
 }
 
+// Events returns the events of a type overlapping the span.
+func (s *filteredSpan) Events(typ string) []Event {
+	return s.track.events.query(typ, overlapping(s.start, s.end), func(e Event) bool {
+		return spanOverlaps(s.start, s.end, e.Start, e.End)
+	})
+}
+
 func (s *filteredSpan) Audio() beep.Streamer {
 	startOffset := time.Duration(s.start - s.track.start)
 	dur := time.Duration(s.end - s.start)
@@ -383,9 +456,18 @@ func (s *filteredSpan) Track() *Track {
 	return s.track
 }
 
-var eventTypes = map[string]reflect.Type{}
-
-func RegisterEvent[T any](name string) {
-	// TODO(Go 1.22) can use reflect.TypeFor[T]()
-	eventTypes[name] = reflect.TypeOf((*T)(nil)).Elem()
+// SubscribeData subscribes fn to events of type typ matching the filter,
+// handing it the event data as T, which must be the type registered for typ
+// with RegisterEvent. The returned Handler can be passed to Unlisten.
+func SubscribeData[T any](s *Session, typ string, filter Filter, fn func(e Event, data T)) Handler {
+	if registered, ok := eventType(typ); ok && registered != reflect.TypeOf((*T)(nil)).Elem() {
+		panic(fmt.Sprintf("tracks: event type %q is registered as %v", typ, registered))
+	}
+	filter.Types = []string{typ}
+	h := HandlerFunc(func(e Event) {
+		data, _ := e.Data.(T)
+		fn(e, data)
+	})
+	s.Subscribe(h, filter)
+	return h
 }
@@ -200,3 +200,112 @@ func TestUpdateEvent(t *testing.T) {
 	assert.Assert(t, track.UpdateEvent(e1))
 	assert.DeepEqual(t, []any{"modified"}, eventData("text"))
 }
+
+func TestEventVersions(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	session := &Session{}
+	track := session.NewTrackAt(0, format)
+	changes := make(chan Event, 10)
+	session.Subscribe(HandlerFunc(func(e Event) {
+		if e.Previous != nil {
+			changes <- e
+		}
+	}), Filter{Types: []string{"text"}})
+
+	e1 := track.RecordEvent("text", "original")
+	assert.Equal(t, 0, e1.Version)
+
+	e1.Data = "modified"
+	assert.Assert(t, track.UpdateEvent(e1))
+	change := <-changes
+	assert.Equal(t, 1, change.Version)
+	assert.Equal(t, "modified", change.Data)
+	assert.Equal(t, "original", change.Previous.Data)
+	assert.Equal(t, 0, change.Previous.Version)
+
+	// updating an event that was never recorded does nothing
+	assert.Assert(t, !track.UpdateEvent(Event{EventMeta: EventMeta{ID: "missing", Type: "text"}}))
+	assert.Equal(t, 1, len(track.Events("text")))
+
+	assert.Assert(t, track.DeleteEvent(e1.ID))
+	change = <-changes
+	assert.Equal(t, 2, change.Version)
+	assert.Assert(t, change.Deleted)
+	assert.Assert(t, !change.Previous.Deleted)
+	assert.DeepEqual(t, []Event(nil), track.Events("text"))
+	assert.DeepEqual(t, []string(nil), track.EventTypes())
+
+	// deleted events are still saved so the deletion survives a reload
+	stored, ok := track.Event(e1.ID)
+	assert.Assert(t, ok)
+	assert.Assert(t, stored.Deleted)
+	assert.Assert(t, stored.Previous == nil)
+	session.Wait()
+	out, err := cbor.Marshal(session)
+	require.NoError(t, err)
+	var session2 Session
+	require.NoError(t, cbor.Unmarshal(out, &session2))
+	assert.DeepEqual(t, session.snapshot(), session2.snapshot(), eqopts)
+}
+
+func TestSupersede(t *testing.T) {
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(1000),
+		NumChannels: 1,
+		Precision:   2,
+	}
+	RegisterEvent[string]("draft")
+	RegisterEvent[string]("final")
+	session := &Session{}
+	track := session.NewTrackAt(0, format)
+	track.AddAudio(generators.Silence(format.SampleRate.N(time.Second)))
+
+	draft1 := track.Span(0, Timestamp(500*time.Millisecond)).RecordEvent("draft", "hel")
+	draft2 := track.Span(0, Timestamp(800*time.Millisecond)).RecordEvent("draft", "hello")
+	final := Supersede(track.Span(0, Timestamp(time.Second)), "final", "hello world", draft1.ID, draft2.ID)
+
+	assert.DeepEqual(t, []Event(nil), track.Events("draft"))
+	assert.DeepEqual(t, []string{"final"}, track.EventTypes())
+	assert.DeepEqual(t, []ID{draft1.ID, draft2.ID}, track.Events("final")[0].Supersedes)
+	assert.Equal(t, final.ID, track.Events("final")[0].ID)
+
+	out, err := cbor.Marshal(session)
+	require.NoError(t, err)
+	var session2 Session
+	require.NoError(t, cbor.Unmarshal(out, &session2))
+	assert.DeepEqual(t, session.snapshot(), session2.snapshot(), eqopts)
+	assert.DeepEqual(t, []Event(nil), session2.Track(track.ID).Events("draft"))
+}
+
+func TestClose(t *testing.T) {
+	format := beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2}
+	session := &Session{}
+	a := session.NewTrackAt(0, format)
+	a.AddAudio(generators.Silence(format.SampleRate.N(time.Second)))
+	b := session.NewTrackAt(0, format)
+
+	var ended []Event
+	session.Subscribe(HandlerFunc(func(e Event) {
+		ended = append(ended, e)
+	}), Filter{Types: []string{"track-end"}})
+
+	a.Close()
+	session.Close()
+	session.Wait()
+	assert.Equal(t, len(ended), 2)
+	assert.Equal(t, len(a.Events("track-end")), 1)
+	assert.Equal(t, a.Events("track-end")[0].Start, a.End())
+	assert.Equal(t, len(b.Events("track-end")), 1)
+
+	// closed tracks stay closed once loaded
+	out, err := cbor.Marshal(session)
+	require.NoError(t, err)
+	var session2 Session
+	require.NoError(t, cbor.Unmarshal(out, &session2))
+	session2.Close()
+	assert.Equal(t, len(session2.Track(a.ID).Events("track-end")), 1)
+}
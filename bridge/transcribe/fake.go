@@ -0,0 +1,111 @@
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// FakeTranscriber transcribes any audio as Text in one segment, with the
+// words spread evenly over the audio.
+type FakeTranscriber struct {
+	Text string
+}
+
+func (t *FakeTranscriber) Transcribe(ctx context.Context, pcm []float32) (*Transcription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	duration := float32(len(pcm)) / float32(Format.SampleRate)
+	out := &Transcription{
+		SourceLanguage:            "en",
+		TargetLanguage:            "en",
+		SourceLanguageProbability: 1,
+		Duration:                  duration,
+	}
+	words := strings.Fields(t.Text)
+	if len(words) == 0 {
+		return out, nil
+	}
+	seg := Segment{
+		End:  duration,
+		Text: t.Text,
+	}
+	step := duration / float32(len(words))
+	for i, w := range words {
+		seg.Words = append(seg.Words, Word{
+			Start:       float32(i) * step,
+			End:         float32(i+1) * step,
+			Word:        w,
+			Probability: 1,
+		})
+	}
+	out.Segments = []Segment{seg}
+	return out, nil
+}
+
+// FakeStreamServer is a streaming transcription server for a StreamAgent,
+// transcribing like FakeTranscriber. It sends a partial result for all the
+// audio so far every Interval of audio, and a final one when the audio ends.
+type FakeStreamServer struct {
+	Text string
+	// Interval is 500ms if zero.
+	Interval time.Duration
+}
+
+func (s *FakeStreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade replied with the error
+		return
+	}
+	defer conn.Close()
+
+	interval := s.Interval
+	if interval == 0 {
+		interval = 500 * time.Millisecond
+	}
+	fake := &FakeTranscriber{Text: s.Text}
+	send := func(pcm []float32, final bool) error {
+		t, err := fake.Transcribe(r.Context(), pcm)
+		if err != nil {
+			return err
+		}
+		return conn.WriteJSON(&StreamResult{
+			Final:         final,
+			End:           t.Duration,
+			Transcription: *t,
+		})
+	}
+	var pcm []float32
+	sent := 0
+	for {
+		typ, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if typ == websocket.TextMessage {
+			// the end of the audio
+			if err := send(pcm, true); err != nil {
+				return
+			}
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+		samples := make([]float32, len(b)/4)
+		binary.Read(bytes.NewReader(b), binary.LittleEndian, samples)
+		pcm = append(pcm, samples...)
+		if len(pcm)-sent >= Format.SampleRate.N(interval) {
+			if err := send(pcm, false); err != nil {
+				return
+			}
+			sent = len(pcm)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package transcribe
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/internal/backend"
+)
+
+// HTTPTranscriber posts the audio to the transcriber service in
+// services/transcriber.
+type HTTPTranscriber struct {
+	Endpoint string
+	// Client is http.DefaultClient if nil.
+	Client *http.Client
+}
+
+type Request struct {
+	AudioData *[]byte `json:"audio_data,omitempty"`
+	Task      string  `json:"task"`
+}
+
+func (t *HTTPTranscriber) Transcribe(ctx context.Context, pcm []float32) (*Transcription, error) {
+	b, err := audio.ToWav(pcm, Format.SampleRate.N(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	body, err := backend.PostJSON(ctx, t.Client, t.Endpoint, &Request{
+		Task:      "transcribe",
+		AudioData: &b,
+	})
+	if err != nil {
+		return nil, err
+	}
+	response := &Transcription{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// StatusError is returned by the HTTP backends when the request fails.
+type StatusError = backend.StatusError
@@ -0,0 +1,136 @@
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/internal/backend"
+)
+
+// OpenAITranscriber uses an OpenAI compatible transcription API, asking for
+// segment and word timestamps.
+type OpenAITranscriber struct {
+	// Endpoint is OpenAI's if empty.
+	Endpoint string
+	APIKey   string
+	// Model is whisper-1 if empty.
+	Model string
+	// Client is http.DefaultClient if nil.
+	Client *http.Client
+}
+
+const openAIEndpoint = "https://api.openai.com/v1/audio/transcriptions"
+
+// openAITranscription is the verbose_json response format.
+type openAITranscription struct {
+	Language string  `json:"language"`
+	Duration float32 `json:"duration"`
+	Segments []struct {
+		ID               uint32  `json:"id"`
+		Seek             uint32  `json:"seek"`
+		Start            float32 `json:"start"`
+		End              float32 `json:"end"`
+		Text             string  `json:"text"`
+		Temperature      float32 `json:"temperature"`
+		AvgLogprob       float32 `json:"avg_logprob"`
+		CompressionRatio float32 `json:"compression_ratio"`
+		NoSpeechProb     float32 `json:"no_speech_prob"`
+	} `json:"segments"`
+	Words []struct {
+		Word  string  `json:"word"`
+		Start float32 `json:"start"`
+		End   float32 `json:"end"`
+	} `json:"words"`
+}
+
+func (t *OpenAITranscriber) Transcribe(ctx context.Context, pcm []float32) (*Transcription, error) {
+	b, err := audio.ToWav(pcm, Format.SampleRate.N(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	model := t.Model
+	if model == "" {
+		model = "whisper-1"
+	}
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, err := form.CreateFormFile("file", "audio.wav")
+	if err != nil {
+		return nil, err
+	}
+	file.Write(b)
+	form.WriteField("model", model)
+	form.WriteField("response_format", "verbose_json")
+	form.WriteField("timestamp_granularities[]", "segment")
+	form.WriteField("timestamp_granularities[]", "word")
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = openAIEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if t.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.APIKey)
+	}
+	data, err := backend.Do(t.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp openAITranscription
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return resp.transcription(), nil
+}
+
+// transcription converts the response, putting the words in the segments
+// they're in.
+func (r *openAITranscription) transcription() *Transcription {
+	out := &Transcription{
+		SourceLanguage: r.Language,
+		TargetLanguage: r.Language,
+		Duration:       r.Duration,
+	}
+	for _, s := range r.Segments {
+		out.Segments = append(out.Segments, Segment{
+			ID:               s.ID,
+			Seek:             s.Seek,
+			Start:            s.Start,
+			End:              s.End,
+			Text:             s.Text,
+			Temperature:      s.Temperature,
+			AvgLogprob:       s.AvgLogprob,
+			CompressionRatio: s.CompressionRatio,
+			NoSpeechProb:     s.NoSpeechProb,
+		})
+	}
+	seg := 0
+	for _, w := range r.Words {
+		if len(out.Segments) == 0 {
+			break
+		}
+		for seg < len(out.Segments)-1 && w.Start >= out.Segments[seg].End {
+			seg++
+		}
+		out.Segments[seg].Words = append(out.Segments[seg].Words, Word{
+			Start: w.Start,
+			End:   w.End,
+			Word:  w.Word,
+			// the API doesn't say how sure it is
+			Probability: 1,
+		})
+	}
+	return out
+}
@@ -0,0 +1,45 @@
+package transcribe
+
+import (
+	"context"
+	"sync"
+
+	"github.com/progrium/webrtc-sessions/bridge/internal/backend"
+)
+
+// PipeTranscriber runs a program like the transcribe.py of minibridge and
+// keeps it running between transcriptions, talking to it like backend.Pipe
+// does with a line of JSON Transcription back for each one. Transcriptions
+// are one at a time.
+type PipeTranscriber struct {
+	Command []string
+
+	once sync.Once
+	p    *backend.Pipe
+}
+
+func (t *PipeTranscriber) pipe() *backend.Pipe {
+	t.once.Do(func() {
+		t.p = &backend.Pipe{Command: t.Command}
+	})
+	return t.p
+}
+
+// Start starts the program ahead of the first transcription, for programs
+// that take a while to load.
+func (t *PipeTranscriber) Start() error {
+	return t.pipe().Start()
+}
+
+func (t *PipeTranscriber) Transcribe(ctx context.Context, pcm []float32) (*Transcription, error) {
+	transcription := &Transcription{}
+	if err := t.pipe().Call(ctx, pcm, transcription); err != nil {
+		return nil, err
+	}
+	return transcription, nil
+}
+
+// Close stops the program.
+func (t *PipeTranscriber) Close() error {
+	return t.pipe().Close()
+}
@@ -0,0 +1,261 @@
+package transcribe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/gorilla/websocket"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+)
+
+func init() {
+	tracks.RegisterEvent[*Transcription]("transcription-draft")
+}
+
+// StreamResult is a message from a streaming transcription server, a
+// hypothesis for the audio from Start to End in seconds since the start of
+// the stream. The times of its segments and words are relative to Start.
+// Partial results are replaced by the next result, final ones are kept and
+// the following results are for audio after them.
+type StreamResult struct {
+	Final bool    `json:"final"`
+	Start float32 `json:"start"`
+	End   float32 `json:"end"`
+	Transcription
+}
+
+// StreamAgent transcribes tracks as they're recorded instead of waiting for
+// each utterance to end. It opens a websocket to Endpoint for every track and
+// sends the audio as binary messages of little endian float32 samples in
+// Format as it's added. Once the track ends it sends the text message "end",
+// the server then sends its last results and closes the connection. The
+// server sends StreamResults as JSON text messages whenever it has them.
+type StreamAgent struct {
+	Endpoint string
+	// Dialer is websocket.DefaultDialer if nil.
+	Dialer *websocket.Dialer
+	// Timeout is how long connecting and waiting for the last results can
+	// take, 30s by default.
+	Timeout time.Duration
+	// Backoff is how long to wait before connecting again once a connection
+	// failed, the audio in between isn't transcribed. 1s by default.
+	Backoff time.Duration
+
+	streams map[tracks.ID]*stream
+	mu      sync.Mutex
+}
+
+// stream is the connection for one track.
+type stream struct {
+	track *tracks.Track
+	conn  *websocket.Conn
+	// start is where on the track the audio sent over conn begins
+	start tracks.Timestamp
+	// connecting is set while the connection is being made, conn is nil
+	// until then
+	connecting bool
+	// failed is when connecting failed, conn is nil until it's tried again
+	failed time.Time
+	// done is closed once all the results have been read
+	done chan struct{}
+	// draft is the "transcription-draft" of the partial results, it's only
+	// used by the read loop
+	draft tracks.Event
+}
+
+func (a *StreamAgent) AudioFormat() beep.Format {
+	return Format
+}
+
+func (a *StreamAgent) Subscription() tracks.Filter {
+	return tracks.Filter{Types: []string{"audio", "track-end"}}
+}
+
+// HandleEvent sends the audio to the server of the track. Partial results
+// are recorded as a "transcription-draft" over the audio they're for, and
+// updated as new ones come in. A final result records a "transcription"
+// superseding the draft, with its segments and words like Agent records
+// them. When the track ends it waits for the last results.
+func (a *StreamAgent) HandleEvent(annot tracks.Event) {
+	track := annot.Track()
+	if annot.Type == "track-end" {
+		a.finish(track.ID)
+		return
+	}
+
+	s := a.stream(track, annot.Start)
+	if s == nil {
+		return
+	}
+	pcm, err := audio.StreamAll(tracks.AudioAs(annot.Span(), Format))
+	if err != nil {
+		log.Println("transcribe:", err)
+		return
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, pcm)
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		log.Println("transcribe:", err)
+		// results already on the way are lost too, the next audio starts over
+		a.mu.Lock()
+		delete(a.streams, track.ID)
+		a.mu.Unlock()
+		s.conn.Close()
+	}
+}
+
+// stream returns the stream of the track, connecting if it isn't yet with
+// the audio starting at start. It returns nil if it can't connect.
+func (a *StreamAgent) stream(track *tracks.Track, start tracks.Timestamp) *stream {
+	a.mu.Lock()
+	if a.streams == nil {
+		a.streams = make(map[tracks.ID]*stream)
+	}
+	s, ok := a.streams[track.ID]
+	backoff := a.Backoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	switch {
+	case ok && s.conn != nil:
+		a.mu.Unlock()
+		return s
+	case ok && (s.connecting || time.Since(s.failed) < backoff):
+		a.mu.Unlock()
+		return nil
+	}
+	// the other tracks go on while this one connects
+	pending := &stream{connecting: true}
+	a.streams[track.ID] = pending
+	a.mu.Unlock()
+
+	dialer := a.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	d := *dialer
+	d.HandshakeTimeout = a.timeout()
+	conn, _, err := d.Dial(a.Endpoint, nil)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.streams[track.ID] != pending {
+		// the track ended while connecting
+		if conn != nil {
+			conn.Close()
+		}
+		return nil
+	}
+	if err != nil {
+		log.Println("transcribe:", err)
+		a.streams[track.ID] = &stream{failed: time.Now()}
+		return nil
+	}
+	s = &stream{
+		track: track,
+		conn:  conn,
+		start: start,
+		done:  make(chan struct{}),
+	}
+	a.streams[track.ID] = s
+	go a.read(s)
+	return s
+}
+
+func (a *StreamAgent) timeout() time.Duration {
+	if a.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return a.Timeout
+}
+
+// finish tells the server the audio of the track ended and waits for the
+// last results.
+func (a *StreamAgent) finish(id tracks.ID) {
+	a.mu.Lock()
+	s := a.streams[id]
+	delete(a.streams, id)
+	a.mu.Unlock()
+	if s == nil || s.conn == nil {
+		return
+	}
+	defer s.conn.Close()
+	if err := s.conn.WriteMessage(websocket.TextMessage, []byte("end")); err != nil {
+		log.Println("transcribe:", err)
+		return
+	}
+	select {
+	case <-s.done:
+	case <-time.After(a.timeout()):
+		log.Println("transcribe: timed out waiting for the last results")
+	}
+}
+
+// Streams returns the number of tracks the agent has a connection for.
+func (a *StreamAgent) Streams() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for _, s := range a.streams {
+		if s.conn != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// read records the results of the stream until the connection closes. Then
+// the draft of the results that weren't final is deleted and the stream is
+// dropped, the next audio of the track connects again.
+func (a *StreamAgent) read(s *stream) {
+	defer close(s.done)
+	for {
+		var r StreamResult
+		if err := s.conn.ReadJSON(&r); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				log.Println("transcribe:", err)
+			}
+			break
+		}
+		s.record(&r)
+	}
+	if s.draft.ID != "" {
+		s.track.DeleteEvent(s.draft.ID)
+		s.draft = tracks.Event{}
+	}
+	a.mu.Lock()
+	if a.streams[s.track.ID] == s {
+		delete(a.streams, s.track.ID)
+	}
+	a.mu.Unlock()
+	s.conn.Close()
+}
+
+func (s *stream) record(r *StreamResult) {
+	at := func(seconds float32) tracks.Timestamp {
+		return s.start + tracks.Timestamp(max(0, float64(seconds))*float64(time.Second))
+	}
+	start := at(r.Start)
+	span := s.track.Span(start, max(start, at(r.End)))
+	if !r.Final {
+		if s.draft.ID == "" {
+			s.draft = span.RecordEvent("transcription-draft", &r.Transcription)
+			return
+		}
+		s.draft.Start, s.draft.End, s.draft.Data = span.Start(), span.End(), &r.Transcription
+		s.track.UpdateEvent(s.draft)
+		return
+	}
+	var drafts []tracks.ID
+	if s.draft.ID != "" {
+		drafts = append(drafts, s.draft.ID)
+	}
+	e := tracks.Supersede(span, "transcription", &r.Transcription, drafts...)
+	recordTimings(e, &r.Transcription)
+	s.draft = tracks.Event{}
+}
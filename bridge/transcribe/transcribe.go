@@ -1,79 +1,322 @@
 package transcribe
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gopxl/beep"
 	"github.com/progrium/webrtc-sessions/bridge/audio"
 	"github.com/progrium/webrtc-sessions/bridge/tracks"
 )
 
-type Agent struct {
+// Format is the audio whisper was trained on.
+var Format = beep.Format{
+	SampleRate:  16000,
+	NumChannels: 1,
+	Precision:   2,
+}
+
+func init() {
+	tracks.RegisterEvent[*Transcription]("transcription")
+	tracks.RegisterEvent[*TranscriptionError]("transcription-error")
+	tracks.RegisterEvent[*TranscribedSegment]("transcription-segment")
+	tracks.RegisterEvent[*TranscribedWord]("transcription-word")
+}
+
+// Transcriber turns speech into text. The audio is mono and in Format.
+type Transcriber interface {
+	Transcribe(ctx context.Context, pcm []float32) (*Transcription, error)
+}
+
+// Backend names a Transcriber implementation for Config.
+type Backend string
+
+const (
+	// HTTP posts the audio as base64 WAV in JSON to the transcriber service.
+	HTTP Backend = "http"
+	// OpenAI posts the audio as a multipart form to an OpenAI compatible
+	// /v1/audio/transcriptions endpoint.
+	OpenAI Backend = "openai"
+	// Pipe streams the audio to a local program over stdin and reads the
+	// transcriptions back from its stdout.
+	Pipe Backend = "pipe"
+	// Fake transcribes everything as the same text, for tests.
+	Fake Backend = "fake"
+)
+
+type Config struct {
+	// Backend is the Transcriber used, HTTP if empty.
+	Backend Backend
+	// Endpoint is the URL the HTTP and OpenAI backends post to.
 	Endpoint string
+	// APIKey and Model are sent to the OpenAI backend.
+	APIKey string
+	Model  string
+	// Command is the program and arguments the Pipe backend runs.
+	Command []string
+	// Text is what the Fake backend transcribes everything as.
+	Text string
+
+	Limits
 }
 
-func (a *Agent) HandleEvent(annot tracks.Event) {
-	if annot.Type != "activity" {
-		return
+// Limits bound how the agent runs transcriptions, zero fields are defaults.
+type Limits struct {
+	// Timeout is how long one attempt can take, 30s by default.
+	Timeout time.Duration
+	// TotalTimeout is how long all the attempts and the waits between them
+	// can take together, 45s by default. The agent handles the events of a
+	// session in order, so this bounds how long a failing transcriber holds
+	// up the rest.
+	TotalTimeout time.Duration
+	// Attempts is how many times a transcription is tried before it's
+	// given up on, 3 by default. Requests the server rejected as bad aren't
+	// tried again.
+	Attempts int
+	// Backoff is the wait before the second attempt, doubling for each one
+	// after up to MaxBackoff. 500ms and 10s by default.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxInFlight is how many transcriptions run at once across all the
+	// sessions the agent handles, 4 by default. The rest wait their turn.
+	MaxInFlight int
+}
+
+func (l *Limits) setDefaults() {
+	if l.Timeout == 0 {
+		l.Timeout = 30 * time.Second
 	}
+	if l.TotalTimeout == 0 {
+		l.TotalTimeout = 45 * time.Second
+	}
+	if l.Attempts == 0 {
+		l.Attempts = 3
+	}
+	if l.Backoff == 0 {
+		l.Backoff = 500 * time.Millisecond
+	}
+	if l.MaxBackoff == 0 {
+		l.MaxBackoff = 10 * time.Second
+	}
+	if l.MaxInFlight == 0 {
+		l.MaxInFlight = 4
+	}
+}
+
+// TranscriptionError is the data of a "transcription-error" event, recorded
+// over speech that couldn't be transcribed.
+type TranscriptionError struct {
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+}
+
+// NewTranscriber returns the Transcriber of the configured backend.
+func NewTranscriber(config Config) (Transcriber, error) {
+	switch config.Backend {
+	case HTTP, "":
+		return &HTTPTranscriber{Endpoint: config.Endpoint}, nil
+	case OpenAI:
+		return &OpenAITranscriber{
+			Endpoint: config.Endpoint,
+			APIKey:   config.APIKey,
+			Model:    config.Model,
+		}, nil
+	case Pipe:
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("transcribe: pipe backend needs a command")
+		}
+		return &PipeTranscriber{Command: config.Command}, nil
+	case Fake:
+		return &FakeTranscriber{Text: config.Text}, nil
+	}
+	return nil, fmt.Errorf("transcribe: unknown backend %q", config.Backend)
+}
+
+type Agent struct {
+	Transcriber Transcriber
+	// Endpoint of an HTTP backend, used if Transcriber isn't set.
+	Endpoint string
+
+	Limits
 
-	pcm, err := audio.StreamAll(annot.Span().Audio())
+	once     sync.Once
+	inFlight chan struct{}
+}
+
+// New returns an agent using the configured backend, it panics if the
+// backend is unknown.
+func New(config Config) *Agent {
+	t, err := NewTranscriber(config)
 	if err != nil {
-		log.Println("transcribe:", err)
+		panic(err)
+	}
+	return &Agent{Transcriber: t, Limits: config.Limits}
+}
+
+func (a *Agent) AudioFormat() beep.Format {
+	return Format
+}
+
+func (a *Agent) Subscription() tracks.Filter {
+	return tracks.Filter{Types: []string{"activity"}}
+}
+
+// HandleEvent records a "transcription" of the speech, followed by a
+// "transcription-segment" for each segment and a "transcription-word" for
+// each word at their times on the track. If the transcription fails every
+// attempt it records a "transcription-error" instead. When the activity was
+// updated the new events supersede the ones recorded for it before, deleted
+// activity is skipped.
+func (a *Agent) HandleEvent(annot tracks.Event) {
+	a.once.Do(func() {
+		a.Limits.setDefaults()
+		a.inFlight = make(chan struct{}, a.MaxInFlight)
+	})
+	if annot.Deleted {
 		return
 	}
-	b, err := audio.ToWav(pcm, 16000)
+
+	pcm, err := audio.StreamAll(tracks.AudioAs(annot.Span(), Format))
 	if err != nil {
 		log.Println("transcribe:", err)
 		return
 	}
 
-	transcription, err := a.Transcribe(&Request{
-		Task:      "transcribe",
-		AudioData: &b,
-	})
+	a.inFlight <- struct{}{}
+	transcription, attempts, err := a.transcribe(pcm)
+	<-a.inFlight
+	earlier := transcribed(annot)
 	if err != nil {
 		log.Println("transcribe:", err)
+		tracks.Supersede(annot.Span(), "transcription-error", &TranscriptionError{
+			Error:    err.Error(),
+			Attempts: attempts,
+		}, earlier...)
 		return
 	}
 
-	annot.Span().RecordEvent("transcription", transcription)
+	e := tracks.Supersede(annot.Span(), "transcription", transcription, earlier...)
+	recordTimings(e, transcription)
 }
 
-func (a *Agent) Transcribe(request *Request) (*Transcription, error) {
-	payloadBytes, err := json.Marshal(request)
-	if err != nil {
-		return nil, err
+// transcribed returns the events recorded for an updated activity before it
+// was changed: the transcription or error over its old span, and the
+// segments and words of the transcription.
+func transcribed(annot tracks.Event) []tracks.ID {
+	if annot.Version == 0 {
+		return nil
 	}
-
-	resp, err := http.Post(a.Endpoint, "application/json", bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return nil, err
+	prev := annot.Previous
+	if prev == nil {
+		prev = &annot
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	track := annot.Track()
+	var ids []tracks.ID
+	transcriptions := make(map[tracks.ID]bool)
+	for _, typ := range []string{"transcription", "transcription-error"} {
+		for _, e := range track.EventsWithin(typ, prev.Start, prev.End) {
+			if e.Start == prev.Start && e.End == prev.End {
+				ids = append(ids, e.ID)
+				transcriptions[e.ID] = true
+			}
+		}
 	}
+	for _, e := range track.EventsWithin("transcription-segment", prev.Start, prev.End) {
+		if seg, ok := e.Data.(*TranscribedSegment); ok && transcriptions[seg.Transcription] {
+			ids = append(ids, e.ID)
+		}
+	}
+	for _, e := range track.EventsWithin("transcription-word", prev.Start, prev.End) {
+		if w, ok := e.Data.(*TranscribedWord); ok && transcriptions[w.Transcription] {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
 
-	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
-		response := &Transcription{}
-		err = json.Unmarshal(body, response)
-		return response, err
-	} else {
-		return nil, fmt.Errorf("transcribe: %s", body)
+// TranscribedSegment is the data of a "transcription-segment" event, whose
+// span is where the segment is on the track.
+type TranscribedSegment struct {
+	Transcription    tracks.ID `json:"transcription"`
+	Text             string    `json:"text"`
+	AvgLogprob       float32   `json:"avg_logprob"`
+	CompressionRatio float32   `json:"compression_ratio"`
+	NoSpeechProb     float32   `json:"no_speech_prob"`
+}
+
+// TranscribedWord is the data of a "transcription-word" event, whose span is
+// where the word is on the track.
+type TranscribedWord struct {
+	Transcription tracks.ID `json:"transcription"`
+	Word          string    `json:"word"`
+	Probability   float32   `json:"prob"`
+}
+
+// recordTimings records the segments and words of the transcription event.
+// Their times are relative to the start of the transcribed audio, they're
+// kept within it since whisper can overshoot the end.
+func recordTimings(e tracks.Event, t *Transcription) {
+	track := e.Track()
+	span := func(start, end float32) tracks.Span {
+		at := func(seconds float32) tracks.Timestamp {
+			ts := e.Start + tracks.Timestamp(float64(seconds)*float64(time.Second))
+			return min(max(ts, e.Start), e.End)
+		}
+		from := at(start)
+		return track.Span(from, max(from, at(end)))
+	}
+	for _, seg := range t.Segments {
+		span(seg.Start, seg.End).RecordEvent("transcription-segment", &TranscribedSegment{
+			Transcription:    e.ID,
+			Text:             seg.Text,
+			AvgLogprob:       seg.AvgLogprob,
+			CompressionRatio: seg.CompressionRatio,
+			NoSpeechProb:     seg.NoSpeechProb,
+		})
+		for _, w := range seg.Words {
+			span(w.Start, w.End).RecordEvent("transcription-word", &TranscribedWord{
+				Transcription: e.ID,
+				Word:          w.Word,
+				Probability:   w.Probability,
+			})
+		}
 	}
 }
 
-type Request struct {
-	AudioData *[]byte `json:"audio_data,omitempty"`
-	Task      string  `json:"task"`
+// transcribe tries to transcribe the audio until it works, it runs out of
+// attempts or TotalTimeout passes, returning how many attempts it took.
+func (a *Agent) transcribe(pcm []float32) (*Transcription, int, error) {
+	t := a.Transcriber
+	if t == nil {
+		t = &HTTPTranscriber{Endpoint: a.Endpoint}
+	}
+	total, cancelTotal := context.WithTimeout(context.Background(), a.TotalTimeout)
+	defer cancelTotal()
+	backoff := a.Backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(total, a.Timeout)
+		transcription, err := t.Transcribe(ctx, pcm)
+		cancel()
+		if err == nil {
+			return transcription, attempt, nil
+		}
+		var status *StatusError
+		if attempt >= a.Attempts || (errors.As(err, &status) && !status.Temporary()) {
+			return nil, attempt, err
+		}
+		log.Printf("transcribe: attempt %d: %v, retrying in %v", attempt, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-total.Done():
+			return nil, attempt, err
+		}
+		backoff = min(backoff*2, a.MaxBackoff)
+	}
 }
 
 type Transcription struct {
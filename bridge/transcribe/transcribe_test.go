@@ -0,0 +1,544 @@
+package transcribe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gopxl/beep"
+	"github.com/gorilla/websocket"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func init() {
+	// recorded by the vad agent, which the tests stand in for
+	tracks.RegisterEvent[any]("activity")
+}
+
+// tone is a second of audio in Format.
+func tone() []float32 {
+	pcm := make([]float32, Format.SampleRate.N(time.Second))
+	for i := range pcm {
+		pcm[i] = float32(0.5 * math.Sin(2*math.Pi*440*float64(i)/float64(Format.SampleRate)))
+	}
+	return pcm
+}
+
+// assertWav checks the WAV has the samples of pcm.
+func assertWav(t *testing.T, pcm []float32, data []byte) {
+	t.Helper()
+	dec, err := audio.DecodeWav(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, dec.Format().SampleRate, Format.SampleRate)
+	got, err := audio.StreamAll(dec)
+	require.NoError(t, err)
+	assert.Equal(t, len(got), len(pcm))
+	assert.Assert(t, math.Abs(float64(got[100]-pcm[100])) < 0.001)
+}
+
+func TestHTTP(t *testing.T) {
+	pcm := tone()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, req.Task, "transcribe")
+		assertWav(t, pcm, *req.AudioData)
+		json.NewEncoder(w).Encode(Transcription{
+			SourceLanguage: "en",
+			Segments:       []Segment{{Text: "hello", End: 1}},
+		})
+	}))
+	defer server.Close()
+
+	tr, err := NewTranscriber(Config{Endpoint: server.URL})
+	require.NoError(t, err)
+	got, err := tr.Transcribe(context.Background(), pcm)
+	require.NoError(t, err)
+	assert.Equal(t, got.Text(), "hello")
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	tr = &HTTPTranscriber{Endpoint: missing.URL}
+	_, err = tr.Transcribe(context.Background(), pcm)
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestOpenAI(t *testing.T) {
+	pcm := tone()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.Header.Get("Authorization"), "Bearer key")
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		assert.Equal(t, r.FormValue("model"), "whisper-1")
+		assert.Equal(t, r.FormValue("response_format"), "verbose_json")
+		assert.DeepEqual(t, r.MultipartForm.Value["timestamp_granularities[]"], []string{"segment", "word"})
+		f, _, err := r.FormFile("file")
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assertWav(t, pcm, data)
+		io.WriteString(w, `{
+			"task": "transcribe", "language": "english", "duration": 1, "text": "hello there world",
+			"segments": [
+				{"id": 0, "start": 0, "end": 0.5, "text": "hello there"},
+				{"id": 1, "start": 0.5, "end": 1, "text": "world"}
+			],
+			"words": [
+				{"word": "hello", "start": 0, "end": 0.2},
+				{"word": "there", "start": 0.2, "end": 0.5},
+				{"word": "world", "start": 0.5, "end": 1}
+			]
+		}`)
+	}))
+	defer server.Close()
+
+	tr, err := NewTranscriber(Config{Backend: OpenAI, Endpoint: server.URL, APIKey: "key"})
+	require.NoError(t, err)
+	got, err := tr.Transcribe(context.Background(), pcm)
+	require.NoError(t, err)
+	assert.Equal(t, got.SourceLanguage, "english")
+	assert.Equal(t, len(got.Segments), 2)
+	assert.Equal(t, got.Text(), "hello there world")
+	assert.DeepEqual(t, got.Segments[0].Words, []Word{
+		{Word: "hello", Start: 0, End: 0.2, Probability: 1},
+		{Word: "there", Start: 0.2, End: 0.5, Probability: 1},
+	})
+	assert.Equal(t, got.Segments[1].Words[0].Word, "world")
+}
+
+// TestPipeHelper is the program the pipe tests run, it transcribes the
+// length of the audio it's given.
+func TestPipeHelper(t *testing.T) {
+	if os.Getenv("TRANSCRIBE_PIPE_HELPER") == "" {
+		t.Skip("only run by the pipe tests")
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		var size int
+		if _, err := fmt.Fscanln(in, &size); err != nil {
+			os.Exit(0)
+		}
+		pcm := make([]float32, size/4)
+		if err := binary.Read(in, binary.LittleEndian, pcm); err != nil {
+			os.Exit(1)
+		}
+		if pcm[0] == -1 {
+			// hang to test cancellation
+			select {}
+		}
+		json.NewEncoder(os.Stdout).Encode(Transcription{
+			Segments: []Segment{{Text: fmt.Sprintf("%d samples", len(pcm))}},
+		})
+	}
+}
+
+func TestPipe(t *testing.T) {
+	os.Setenv("TRANSCRIBE_PIPE_HELPER", "1")
+	defer os.Unsetenv("TRANSCRIBE_PIPE_HELPER")
+	tr := &PipeTranscriber{Command: []string{os.Args[0], "-test.run=^TestPipeHelper$"}}
+	defer tr.Close()
+
+	for _, n := range []int{16000, 800} {
+		got, err := tr.Transcribe(context.Background(), tone()[:n])
+		require.NoError(t, err)
+		assert.Equal(t, got.Text(), fmt.Sprintf("%d samples", n))
+	}
+
+	// the program is restarted after a transcription is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := tr.Transcribe(ctx, []float32{-1})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	got, err := tr.Transcribe(context.Background(), tone()[:10])
+	require.NoError(t, err)
+	assert.Equal(t, got.Text(), "10 samples")
+
+	_, err = NewTranscriber(Config{Backend: Pipe})
+	assert.ErrorContains(t, err, "needs a command")
+	_, err = NewTranscriber(Config{Backend: "nope"})
+	assert.ErrorContains(t, err, "unknown backend")
+}
+
+func TestAgent(t *testing.T) {
+	session := tracks.NewSession()
+	session.Listen(New(Config{Backend: Fake, Text: "one two three four"}))
+	track := session.NewTrackAt(0, beep.Format{SampleRate: 48000, NumChannels: 2, Precision: 2})
+	track.AddAudio(beep.Silence(48000 * 2))
+	activity := track.Span(tracks.Timestamp(time.Second), tracks.Timestamp(2*time.Second)).RecordEvent("activity", nil)
+	session.Wait()
+
+	events := track.Events("transcription")
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Start, activity.Start)
+	assert.Equal(t, events[0].End, activity.End)
+	transcription := events[0].Data.(*Transcription)
+	assert.Equal(t, transcription.Text(), "one two three four")
+	words := transcription.Segments[0].Words
+	assert.Equal(t, len(words), 4)
+	assert.Assert(t, math.Abs(float64(words[3].End-1)) < 0.01, "%v", words[3])
+
+	// the segment and words are placed on the track
+	ms := func(n int) tracks.Timestamp { return tracks.Timestamp(time.Duration(n) * time.Millisecond) }
+	near := func(a, b tracks.Timestamp) bool {
+		return time.Duration(a-b).Abs() < time.Millisecond
+	}
+	segments := track.Events("transcription-segment")
+	assert.Equal(t, len(segments), 1)
+	assert.Equal(t, segments[0].Start, ms(1000))
+	assert.Assert(t, near(segments[0].End, ms(2000)))
+	assert.DeepEqual(t, segments[0].Data, &TranscribedSegment{Transcription: events[0].ID, Text: "one two three four"})
+	wordEvents := track.Events("transcription-word")
+	assert.Equal(t, len(wordEvents), 4)
+	for i, e := range wordEvents {
+		assert.Assert(t, near(e.Start, ms(1000+250*i)), "%v", e)
+		assert.Assert(t, near(e.End, ms(1250+250*i)), "%v", e)
+		assert.DeepEqual(t, e.Data, &TranscribedWord{Transcription: events[0].ID, Word: words[i].Word, Probability: 1})
+	}
+	assert.Equal(t, len(track.EventsAt("transcription-word", ms(1600))), 1)
+	assert.Equal(t, track.EventsAt("transcription-word", ms(1600))[0].Data.(*TranscribedWord).Word, "three")
+
+	// the events are registered so the session loads again
+	b, err := cbor.Marshal(session)
+	assert.NilError(t, err)
+	loaded := &tracks.Session{}
+	assert.NilError(t, cbor.Unmarshal(b, loaded))
+	for _, typ := range []string{"transcription", "transcription-segment", "transcription-word"} {
+		assert.DeepEqual(t, loaded.Track(track.ID).Events(typ)[0].Data, track.Events(typ)[0].Data)
+	}
+}
+
+func TestRecordTimings(t *testing.T) {
+	session := &tracks.Session{}
+	track := session.NewTrackAt(0, Format)
+	track.AddAudio(beep.Silence(Format.SampleRate.N(3 * time.Second)))
+	e := track.Span(tracks.Timestamp(time.Second), tracks.Timestamp(2*time.Second)).RecordEvent("transcription", nil)
+	recordTimings(e, &Transcription{Segments: []Segment{{
+		Start: 0.5, End: 1.2, Text: "over",
+		Words: []Word{{Start: 0.5, End: 0.9, Word: "over", Probability: 0.5}, {Start: 1.1, End: 1.2, Word: "shoot", Probability: 0.2}},
+	}}})
+	seg := track.Events("transcription-segment")[0]
+	assert.Equal(t, seg.Start, tracks.Timestamp(1500*time.Millisecond))
+	assert.Equal(t, seg.End, e.End)
+	words := track.Events("transcription-word")
+	assert.Equal(t, len(words), 2)
+	assert.Equal(t, words[0].Data.(*TranscribedWord).Probability, float32(0.5))
+	// past the end of the audio
+	assert.Equal(t, words[1].Start, e.End)
+	assert.Equal(t, words[1].End, e.End)
+}
+
+func TestAgentUpdates(t *testing.T) {
+	session := tracks.NewSession()
+	session.Listen(New(Config{Backend: Fake, Text: "one two"}))
+	var recorded int
+	session.Subscribe(tracks.HandlerFunc(func(e tracks.Event) {
+		recorded++
+	}), tracks.Filter{Types: []string{"transcription"}})
+	track := session.NewTrackAt(0, Format)
+	track.AddAudio(beep.Silence(Format.SampleRate.N(3 * time.Second)))
+	activity := track.Span(tracks.Timestamp(time.Second), tracks.Timestamp(2*time.Second)).RecordEvent("activity", nil)
+	session.Wait()
+	first := track.Events("transcription")[0]
+
+	// the speech turned out to go on longer
+	activity.End = tracks.Timestamp(3 * time.Second)
+	assert.Assert(t, track.UpdateEvent(activity))
+	session.Wait()
+	events := track.Events("transcription")
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].End, activity.End)
+	assert.DeepEqual(t, events[0].Supersedes[0], first.ID)
+	assert.Equal(t, len(track.Events("transcription-segment")), 1)
+	words := track.Events("transcription-word")
+	assert.Equal(t, len(words), 2)
+	for _, w := range words {
+		assert.Equal(t, w.Data.(*TranscribedWord).Transcription, events[0].ID)
+	}
+
+	assert.Assert(t, track.DeleteEvent(activity.ID))
+	session.Wait()
+	assert.Equal(t, recorded, 2)
+}
+
+// transcribeActivity records an activity event on a new track of the
+// session and returns the track.
+func transcribeActivity(session *tracks.Session) *tracks.Track {
+	track := session.NewTrackAt(0, Format)
+	track.AddAudio(beep.Silence(Format.SampleRate.N(time.Second)))
+	track.RecordEvent("activity", nil)
+	return track
+}
+
+func TestRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := requests.Add(1); {
+		case r.URL.Path == "/bad":
+			http.Error(w, "bad audio", http.StatusBadRequest)
+		case r.URL.Path == "/hang":
+			// the disconnect is only noticed once the body is read
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+		case n < 3:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			json.NewEncoder(w).Encode(Transcription{Segments: []Segment{{Text: "hello"}}})
+		}
+	}))
+	defer server.Close()
+
+	limits := Limits{Timeout: 100 * time.Millisecond, Backoff: time.Millisecond}
+	for _, tt := range []struct {
+		name     string
+		path     string
+		total    time.Duration
+		text     string
+		err      string
+		attempts int
+	}{
+		{name: "ok", path: "/", text: "hello", attempts: 3},
+		// rejected requests aren't retried
+		{name: "bad", path: "/bad", err: "400 Bad Request: bad audio", attempts: 1},
+		{name: "hang", path: "/hang", err: "deadline exceeded", attempts: 3},
+		// the second attempt runs out of the total time
+		{name: "total", path: "/hang", total: 150 * time.Millisecond, err: "deadline exceeded", attempts: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			limits := limits
+			limits.TotalTimeout = tt.total
+			session := tracks.NewSession()
+			session.Listen(New(Config{Endpoint: server.URL + tt.path, Limits: limits}))
+			track := transcribeActivity(session)
+			session.Wait()
+
+			assert.Equal(t, int(requests.Load()), tt.attempts)
+			if tt.err == "" {
+				assert.Equal(t, track.Events("transcription")[0].Data.(*Transcription).Text(), tt.text)
+				assert.Equal(t, len(track.Events("transcription-error")), 0)
+				return
+			}
+			assert.Equal(t, len(track.Events("transcription")), 0)
+			errs := track.Events("transcription-error")
+			assert.Equal(t, len(errs), 1)
+			data := errs[0].Data.(*TranscriptionError)
+			assert.ErrorContains(t, errors.New(data.Error), tt.err)
+			assert.Equal(t, data.Attempts, tt.attempts)
+		})
+	}
+}
+
+// slowTranscriber keeps track of how many transcriptions run at once.
+type slowTranscriber struct {
+	running, most atomic.Int32
+}
+
+func (t *slowTranscriber) Transcribe(ctx context.Context, pcm []float32) (*Transcription, error) {
+	n := t.running.Add(1)
+	defer t.running.Add(-1)
+	for {
+		most := t.most.Load()
+		if n <= most || t.most.CompareAndSwap(most, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return &Transcription{}, nil
+}
+
+func TestMaxInFlight(t *testing.T) {
+	transcriber := &slowTranscriber{}
+	agent := &Agent{Transcriber: transcriber, Limits: Limits{MaxInFlight: 2}}
+	var sessions []*tracks.Session
+	for i := 0; i < 6; i++ {
+		session := tracks.NewSession()
+		session.Listen(agent)
+		sessions = append(sessions, session)
+	}
+	var all []*tracks.Track
+	for _, session := range sessions {
+		all = append(all, transcribeActivity(session))
+	}
+	for _, session := range sessions {
+		session.Wait()
+	}
+	assert.Equal(t, int(transcriber.most.Load()), 2)
+	for _, track := range all {
+		assert.Equal(t, len(track.Events("transcription")), 1)
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := httptest.NewServer(&FakeStreamServer{Text: "one two three four", Interval: 500 * time.Millisecond})
+	defer server.Close()
+	agent := &StreamAgent{Endpoint: "ws" + strings.TrimPrefix(server.URL, "http")}
+	ms := func(n int) tracks.Timestamp { return tracks.Timestamp(time.Duration(n) * time.Millisecond) }
+
+	session := tracks.NewSession()
+	session.Listen(agent)
+	var drafts []tracks.Event
+	session.Subscribe(tracks.HandlerFunc(func(e tracks.Event) {
+		drafts = append(drafts, e)
+	}), tracks.Filter{Types: []string{"transcription-draft"}})
+
+	start := tracks.Timestamp(time.Second)
+	track := session.NewTrackAt(start, Format)
+	for i := 0; i < 20; i++ {
+		track.AddAudio(beep.Silence(Format.SampleRate.N(100 * time.Millisecond)))
+	}
+	session.Wait()
+	assert.Equal(t, agent.Streams(), 1)
+	session.Close()
+	session.Wait()
+	assert.Equal(t, agent.Streams(), 0)
+
+	// a partial every 500ms of audio, all versions of the same draft
+	assert.Equal(t, len(drafts), 4)
+	for i, draft := range drafts {
+		assert.Equal(t, draft.ID, drafts[0].ID)
+		assert.Equal(t, draft.Start, start)
+		assert.Equal(t, draft.End, start+ms(500*(i+1)))
+	}
+	assert.Equal(t, len(track.Events("transcription-draft")), 0)
+
+	events := track.Events("transcription")
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Start, start)
+	assert.Equal(t, events[0].End, track.End())
+	assert.DeepEqual(t, events[0].Supersedes, []tracks.ID{drafts[0].ID})
+	assert.Equal(t, events[0].Data.(*Transcription).Text(), "one two three four")
+	words := track.Events("transcription-word")
+	assert.Equal(t, len(words), 4)
+	assert.Equal(t, words[1].Start, start+ms(500))
+}
+
+func TestStreamUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	agent := &StreamAgent{Endpoint: "ws" + strings.TrimPrefix(server.URL, "http"), Backoff: time.Hour}
+	server.Close()
+
+	session := tracks.NewSession()
+	session.Listen(agent)
+	track := session.NewTrackAt(0, Format)
+	track.AddAudio(beep.Silence(Format.SampleRate.N(time.Second)))
+	track.AddAudio(beep.Silence(Format.SampleRate.N(time.Second)))
+	session.Close()
+	session.Wait()
+	assert.Equal(t, agent.Streams(), 0)
+	assert.DeepEqual(t, track.EventTypes(), []string{"track-end"})
+}
+
+func TestStreamServerClose(t *testing.T) {
+	var conns atomic.Int32
+	fake := &FakeStreamServer{Text: "one two", Interval: 500 * time.Millisecond}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conns.Add(1) > 1 {
+			fake.ServeHTTP(w, r)
+			return
+		}
+		// the first connection sends a partial result and goes away
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+		conn.WriteJSON(&StreamResult{End: 0.5, Transcription: Transcription{Segments: []Segment{{Text: " one"}}}})
+	}))
+	defer server.Close()
+	agent := &StreamAgent{Endpoint: "ws" + strings.TrimPrefix(server.URL, "http")}
+
+	session := tracks.NewSession()
+	session.Listen(agent)
+	var drafts atomic.Int32
+	session.Subscribe(tracks.HandlerFunc(func(e tracks.Event) {
+		drafts.Add(1)
+	}), tracks.Filter{Types: []string{"transcription-draft"}})
+	track := session.NewTrackAt(0, Format)
+	track.AddAudio(beep.Silence(Format.SampleRate.N(500 * time.Millisecond)))
+	session.Wait()
+	for deadline := time.Now().Add(5 * time.Second); agent.Streams() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stream kept after the server closed it")
+		}
+	}
+	session.Wait()
+	assert.Assert(t, drafts.Load() > 0)
+	assert.Equal(t, len(track.Events("transcription-draft")), 0)
+
+	// the next audio connects again
+	track.AddAudio(beep.Silence(Format.SampleRate.N(500 * time.Millisecond)))
+	session.Wait()
+	assert.Equal(t, agent.Streams(), 1)
+	session.Close()
+	session.Wait()
+	assert.Equal(t, conns.Load(), int32(2))
+	assert.Equal(t, len(track.Events("transcription-draft")), 0)
+	assert.Equal(t, len(track.Events("transcription")), 1)
+}
+
+func TestStreamSlowConnect(t *testing.T) {
+	server := httptest.NewServer(&FakeStreamServer{Text: "one two", Interval: 500 * time.Millisecond})
+	defer server.Close()
+	release := make(chan struct{})
+	var dials atomic.Int32
+	dialer := &websocket.Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			// the first track's server is unreachable
+			<-release
+			return nil, errors.New("unreachable")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	agent := &StreamAgent{Endpoint: "ws" + strings.TrimPrefix(server.URL, "http"), Dialer: dialer}
+
+	slow := tracks.NewSession()
+	slow.Listen(agent)
+	slow.NewTrackAt(0, Format).AddAudio(beep.Silence(Format.SampleRate.N(100 * time.Millisecond)))
+	for dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the other tracks go on meanwhile
+	session := tracks.NewSession()
+	session.Listen(agent)
+	track := session.NewTrackAt(0, Format)
+	track.AddAudio(beep.Silence(Format.SampleRate.N(100 * time.Millisecond)))
+	waited := make(chan struct{})
+	go func() {
+		session.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked by the other track connecting")
+	}
+	assert.Equal(t, agent.Streams(), 1)
+
+	close(release)
+	slow.Wait()
+	slow.Close()
+	session.Close()
+	slow.Wait()
+	session.Wait()
+	assert.Equal(t, agent.Streams(), 0)
+	assert.Equal(t, len(track.Events("transcription")), 1)
+}
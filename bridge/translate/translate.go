@@ -0,0 +1,174 @@
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/progrium/webrtc-sessions/bridge/internal/backend"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"github.com/progrium/webrtc-sessions/bridge/transcribe"
+)
+
+func init() {
+	tracks.RegisterEvent[*Translation]("translation")
+}
+
+// Translator translates text into the target language. Languages are names
+// or codes like "english" or "en". The bundled service needs the source
+// language, it returns no text without one.
+type Translator interface {
+	Translate(ctx context.Context, text, source, target string) (string, error)
+}
+
+// HTTPTranslator posts the text to the translator service in
+// services/translator.
+type HTTPTranslator struct {
+	Endpoint string
+	// Client is http.DefaultClient if nil.
+	Client *http.Client
+}
+
+type Request struct {
+	Text           *string `json:"text,omitempty"`
+	Task           string  `json:"task"`
+	SourceLanguage *string `json:"source_language,omitempty"`
+	TargetLanguage *string `json:"target_language,omitempty"`
+}
+
+func (t *HTTPTranslator) Translate(ctx context.Context, text, source, target string) (string, error) {
+	request := &Request{
+		Task:           "translate",
+		Text:           &text,
+		TargetLanguage: &target,
+	}
+	if source != "" {
+		request.SourceLanguage = &source
+	}
+	body, err := backend.PostJSON(ctx, t.Client, t.Endpoint, request)
+	if err != nil {
+		return "", err
+	}
+	// the service answers like the transcriber does
+	response := &transcribe.Transcription{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response.Text()), nil
+}
+
+// Translation is the data of a "translation" event, recorded over the same
+// span as the transcription it translates.
+type Translation struct {
+	Transcription  tracks.ID `json:"transcription"`
+	SourceLanguage string    `json:"source_language"`
+	TargetLanguage string    `json:"target_language"`
+	Text           string    `json:"text"`
+}
+
+type Config struct {
+	// Endpoint is where the translator service is.
+	Endpoint string
+	// Targets are the languages transcriptions are translated into.
+	Targets []string
+	// Timeout is how long a translation can take, 30s by default.
+	Timeout time.Duration
+}
+
+type Agent struct {
+	Translator Translator
+	Targets    []string
+	Timeout    time.Duration
+}
+
+func New(config Config) *Agent {
+	return &Agent{
+		Translator: &HTTPTranslator{Endpoint: config.Endpoint},
+		Targets:    config.Targets,
+		Timeout:    config.Timeout,
+	}
+}
+
+func (a *Agent) Subscription() tracks.Filter {
+	return tracks.Filter{Types: []string{"transcription"}}
+}
+
+// HandleEvent records a "translation" of the transcription for each target
+// language, except the one it's already in. Transcriptions without a source
+// language are skipped, translations that fail or come back empty are logged
+// and skipped.
+func (a *Agent) HandleEvent(annot tracks.Event) {
+	transcription, ok := annot.Data.(*transcribe.Transcription)
+	if !ok {
+		return
+	}
+	// whisper starts segments with a space, Text adds another
+	text := strings.Join(strings.Fields(transcription.Text()), " ")
+	if text == "" {
+		return
+	}
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	source := transcription.SourceLanguage
+	if source == "" {
+		return
+	}
+	for _, target := range a.Targets {
+		if sameLanguage(source, target) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		translated, err := a.Translator.Translate(ctx, text, source, target)
+		cancel()
+		if err != nil {
+			log.Printf("translate: %s to %s: %v", annot.ID, target, err)
+			continue
+		}
+		if translated == "" {
+			log.Printf("translate: %s to %s: no text", annot.ID, target)
+			continue
+		}
+		annot.Span().RecordEvent("translation", &Translation{
+			Transcription:  annot.ID,
+			SourceLanguage: source,
+			TargetLanguage: target,
+			Text:           translated,
+		})
+	}
+}
+
+// languageCodes are the names of the languages whisper reports codes for
+// that are likely to be configured as targets by name.
+var languageCodes = map[string]string{
+	"english":    "en",
+	"spanish":    "es",
+	"french":     "fr",
+	"german":     "de",
+	"italian":    "it",
+	"portuguese": "pt",
+	"dutch":      "nl",
+	"russian":    "ru",
+	"chinese":    "zh",
+	"japanese":   "ja",
+	"korean":     "ko",
+	"arabic":     "ar",
+	"hindi":      "hi",
+}
+
+// sameLanguage reports whether two languages are the same, given as names or
+// codes.
+func sameLanguage(a, b string) bool {
+	code := func(lang string) string {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if c, ok := languageCodes[lang]; ok {
+			return c
+		}
+		return lang
+	}
+	return a != "" && code(a) == code(b)
+}
@@ -0,0 +1,79 @@
+package translate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"github.com/progrium/webrtc-sessions/bridge/transcribe"
+	"gotest.tools/assert"
+)
+
+func TestAgent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Task != "translate" || req.Text == nil || req.TargetLanguage == nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if *req.TargetLanguage == "latin" {
+			json.NewEncoder(w).Encode(&transcribe.Transcription{})
+			return
+		}
+		if *req.TargetLanguage == "klingon" {
+			http.Error(w, "unknown language", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&transcribe.Transcription{
+			TargetLanguage: *req.TargetLanguage,
+			Segments: []transcribe.Segment{{
+				Text: " " + *req.SourceLanguage + " to " + *req.TargetLanguage + ": " + *req.Text,
+			}},
+		})
+	}))
+	defer server.Close()
+
+	session := tracks.NewSession()
+	session.Listen(New(Config{
+		Endpoint: server.URL,
+		Targets:  []string{"English", "spanish", "klingon", "latin", "fr"},
+	}))
+	format := beep.Format{SampleRate: 16000, NumChannels: 1, Precision: 2}
+	track := session.NewTrackAt(0, format)
+	track.AddAudio(beep.Silence(format.SampleRate.N(2 * time.Second)))
+	e := track.Span(tracks.Timestamp(time.Second), tracks.Timestamp(2*time.Second)).RecordEvent("transcription", &transcribe.Transcription{
+		SourceLanguage: "en",
+		Segments:       []transcribe.Segment{{Text: " hello"}, {Text: " world"}},
+	})
+	session.Wait()
+
+	// without a source language there's nothing to translate from
+	track.RecordEvent("transcription", &transcribe.Transcription{
+		Segments: []transcribe.Segment{{Text: " bonjour"}},
+	})
+	session.Wait()
+
+	// not into english since it already is, klingon failed and latin was empty
+	var translations []*Translation
+	for _, tr := range track.Events("translation") {
+		assert.Equal(t, tr.Start, e.Start)
+		assert.Equal(t, tr.End, e.End)
+		translations = append(translations, tr.Data.(*Translation))
+	}
+	assert.DeepEqual(t, translations, []*Translation{
+		{Transcription: e.ID, SourceLanguage: "en", TargetLanguage: "spanish", Text: "en to spanish: hello world"},
+		{Transcription: e.ID, SourceLanguage: "en", TargetLanguage: "fr", Text: "en to fr: hello world"},
+	})
+}
+
+func TestSameLanguage(t *testing.T) {
+	assert.Assert(t, sameLanguage("en", "English"))
+	assert.Assert(t, sameLanguage("fr", "fr"))
+	assert.Assert(t, !sameLanguage("en", "spanish"))
+	// unknown isn't the same as anything
+	assert.Assert(t, !sameLanguage("", ""))
+}
@@ -0,0 +1,210 @@
+package vad
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// Detector decides whether audio contains speech. It's given the most recent
+// stretch of a track's audio as mono samples at the agent's sample rate, so
+// detectors working on short frames should look at all of them. Detectors
+// can keep state, every track gets its own.
+type Detector interface {
+	Detect(pcm []float32) bool
+}
+
+// Backend names a Detector implementation for Config.
+type Backend string
+
+const (
+	// Energy compares the mean energy and amplitude to fixed thresholds. It's
+	// cheap but anything loud enough counts as speech.
+	Energy Backend = "energy"
+	// GMM models the energy in the speech frequency bands with Gaussian
+	// mixtures for speech and noise, like the WebRTC VAD.
+	GMM Backend = "gmm"
+	// Spectral looks for voiced frames, with a low zero crossing rate, whose
+	// spectrum keeps changing like speech does, which rules out both noise
+	// and steady tones like hum.
+	Spectral Backend = "spectral"
+)
+
+const (
+	// this is an arbitrary number I picked after testing a bit
+	// feel free to play around
+	defaultEnergyThresh  = 0.0005
+	defaultSilenceThresh = 0.015
+	defaultStopRatio     = 1
+)
+
+// NewDetector returns a new detector of the given backend for audio at the
+// given sample rate. An empty backend is Energy.
+func NewDetector(backend Backend, sampleRate int) (Detector, error) {
+	switch backend {
+	case Energy, "":
+		return &EnergyDetector{
+			EnergyThresh:  defaultEnergyThresh,
+			SilenceThresh: defaultSilenceThresh,
+			StopRatio:     defaultStopRatio,
+		}, nil
+	case GMM:
+		return NewGMMDetector(sampleRate), nil
+	case Spectral:
+		return NewSpectralDetector(sampleRate), nil
+	}
+	return nil, fmt.Errorf("vad: unknown backend %q", backend)
+}
+
+// EnergyDetector is the detector of VAD. Once it detects speech the
+// thresholds are scaled by StopRatio until it stops, so with a StopRatio
+// under 1 audio hovering around the thresholds doesn't flip back and forth.
+type EnergyDetector struct {
+	EnergyThresh  float32
+	SilenceThresh float32
+	StopRatio     float32
+
+	speaking bool
+}
+
+func (d *EnergyDetector) Detect(pcm []float32) bool {
+	energyThresh, silenceThresh := d.EnergyThresh, d.SilenceThresh
+	if d.speaking {
+		// silence is an amplitude so it scales with the root of energy
+		energyThresh *= d.StopRatio
+		silenceThresh *= float32(math.Sqrt(float64(d.StopRatio)))
+	}
+	d.speaking, _, _ = VAD(pcm, energyThresh, silenceThresh)
+	return d.speaking
+}
+
+// Reset forgets about any speech going on, so the next audio has to pass
+// the start thresholds again.
+func (d *EnergyDetector) Reset() {
+	d.speaking = false
+}
+
+// resetter is implemented by detectors that keep track of ongoing speech,
+// they're reset whenever the window is flushed.
+type resetter interface {
+	Reset()
+}
+
+// minNoiseFloor keeps digital silence from putting adaptive thresholds at
+// zero, it's about -70dBFS.
+const minNoiseFloor = 1e-7
+
+// noiseFloor estimates the energy of the background noise from 10ms frames.
+// It follows quieter frames down right away and louder ones up slowly, so
+// the pauses in speech keep it low while steady noise raises it within a few
+// seconds.
+type noiseFloor struct {
+	energy    float64
+	frameSize int
+	// rise is how far the estimate moves towards a louder frame per frame
+	rise float64
+}
+
+func newNoiseFloor(sampleRate int) *noiseFloor {
+	return &noiseFloor{
+		frameSize: sampleRate / 100,
+		// a time constant of 3s
+		rise: 0.01 / 3,
+	}
+}
+
+func (n *noiseFloor) update(pcm []float32) {
+	frames(pcm, n.frameSize, func(frame []float32) {
+		var e float64
+		for _, v := range frame {
+			e += float64(v) * float64(v)
+		}
+		e = math.Max(e/float64(len(frame)), minNoiseFloor)
+		switch {
+		case n.energy == 0 || e < n.energy:
+			n.energy = e
+		default:
+			n.energy += (e - n.energy) * n.rise
+		}
+	})
+}
+
+// speechRatio is the share of frames a frame based detector needs to find
+// speech in to count the audio as speech.
+const speechRatio = 0.2
+
+// frames calls f for each whole frame of size samples in pcm.
+func frames(pcm []float32, size int, f func(frame []float32)) {
+	for i := 0; i+size <= len(pcm); i += size {
+		f(pcm[i : i+size])
+	}
+}
+
+// spectrum holds the buffers for the power spectra of frames of one size.
+type spectrum struct {
+	window []float64
+	buf    []complex128
+	power  []float64
+}
+
+func newSpectrum(frameSize int) *spectrum {
+	n := 1
+	for n < frameSize {
+		n *= 2
+	}
+	window := make([]float64, frameSize)
+	for i := range window {
+		// Hann
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))
+	}
+	return &spectrum{
+		window: window,
+		buf:    make([]complex128, n),
+		power:  make([]float64, n/2+1),
+	}
+}
+
+// compute fills power with the power of each frequency bin of the frame,
+// scaled so a full scale sine comes out around 1 whatever the frame size.
+func (s *spectrum) compute(frame []float32) []float64 {
+	for i := range s.buf {
+		s.buf[i] = 0
+	}
+	for i, v := range frame {
+		s.buf[i] = complex(float64(v)*s.window[i], 0)
+	}
+	fft(s.buf)
+	// a sine peaks at A*N/4 with the Hann window
+	scale := 16 / float64(len(frame)*len(frame))
+	for i := range s.power {
+		a := cmplx.Abs(s.buf[i])
+		s.power[i] = a * a * scale
+	}
+	return s.power
+}
+
+// fft is an in place radix-2 FFT, len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
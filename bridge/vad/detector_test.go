@@ -0,0 +1,237 @@
+package vad
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+const testSampleRate = 16000
+
+// labeledAudio is mono audio along with whether each sample is speech.
+type labeledAudio struct {
+	pcm    []float32
+	speech []bool
+}
+
+func (l *labeledAudio) add(speech bool, pcm []float32) {
+	l.pcm = append(l.pcm, pcm...)
+	for range pcm {
+		l.speech = append(l.speech, speech)
+	}
+}
+
+// syntheticSpeech is voiced audio with a wandering pitch, harmonics falling
+// off with frequency and syllables about four times a second.
+func syntheticSpeech(rng *rand.Rand, d time.Duration, amp float64) []float32 {
+	n := int(d.Seconds() * testSampleRate)
+	out := make([]float32, n)
+	var phase float64
+	syllable := 0.25 + rng.Float64()*0.1
+	for i := range out {
+		t := float64(i) / testSampleRate
+		f0 := 140 + 40*math.Sin(2*math.Pi*0.7*t)
+		phase += 2 * math.Pi * f0 / testSampleRate
+		var v float64
+		for h := 1; h <= 20; h++ {
+			v += math.Sin(float64(h)*phase) / float64(h)
+		}
+		envelope := math.Abs(math.Sin(math.Pi * t / syllable))
+		out[i] = float32(amp * envelope * v / 2)
+	}
+	return out
+}
+
+func whiteNoise(rng *rand.Rand, d time.Duration, amp float64) []float32 {
+	out := make([]float32, int(d.Seconds()*testSampleRate))
+	for i := range out {
+		out[i] = float32(amp * rng.NormFloat64())
+	}
+	return out
+}
+
+func hum(d time.Duration, amp float64) []float32 {
+	out := make([]float32, int(d.Seconds()*testSampleRate))
+	for i := range out {
+		out[i] = float32(amp * math.Sin(2*math.Pi*60*float64(i)/testSampleRate))
+	}
+	return out
+}
+
+func mix(a, b []float32) []float32 {
+	for i := range a {
+		a[i] += b[i]
+	}
+	return a
+}
+
+// syntheticRecording is a mix of speech with background noise, silence and
+// the kinds of non-speech that trip detectors up.
+func syntheticRecording() *labeledAudio {
+	rng := rand.New(rand.NewSource(1))
+	background := func(d time.Duration) []float32 {
+		return whiteNoise(rng, d, 0.0005)
+	}
+	rec := &labeledAudio{}
+	rec.add(false, background(time.Second))
+	rec.add(true, mix(syntheticSpeech(rng, 2*time.Second, 0.2), background(2*time.Second)))
+	rec.add(false, background(time.Second))
+	rec.add(false, whiteNoise(rng, time.Second, 0.05))
+	rec.add(false, background(time.Second))
+	rec.add(true, mix(syntheticSpeech(rng, 2*time.Second, 0.05), background(2*time.Second)))
+	rec.add(false, mix(hum(time.Second, 0.05), background(time.Second)))
+	rec.add(true, mix(syntheticSpeech(rng, time.Second, 0.1), background(time.Second)))
+	rec.add(false, background(time.Second))
+	return rec
+}
+
+// loadRecordings reads any labeled recordings in testdata, WAV files with a
+// .labels file next to them listing the speech in them as start and end
+// seconds, one range per line.
+func loadRecordings(t *testing.T) map[string]*labeledAudio {
+	t.Helper()
+	paths, err := filepath.Glob("testdata/*.wav")
+	require.NoError(t, err)
+	recs := map[string]*labeledAudio{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		dec, err := audio.DecodeWav(f)
+		require.NoError(t, err)
+		pcm, err := audio.StreamAll(audio.Resample(dec, dec.Format().SampleRate, testSampleRate))
+		f.Close()
+		require.NoError(t, err)
+
+		rec := &labeledAudio{pcm: pcm, speech: make([]bool, len(pcm))}
+		labels, err := os.Open(strings.TrimSuffix(path, ".wav") + ".labels")
+		require.NoError(t, err)
+		scanner := bufio.NewScanner(labels)
+		for scanner.Scan() {
+			var start, end float64
+			_, err := fmt.Sscan(scanner.Text(), &start, &end)
+			require.NoError(t, err)
+			for i := int(start * testSampleRate); i < min(int(end*testSampleRate), len(pcm)); i++ {
+				rec.speech[i] = true
+			}
+		}
+		labels.Close()
+		recs[filepath.Base(path)] = rec
+	}
+	return recs
+}
+
+// evaluate runs the detector over windows of the recording the way the
+// agent does and scores it against the labels. Windows with both speech and
+// non-speech in them are skipped since either answer is right.
+func evaluate(det Detector, rec *labeledAudio) (precision, recall float64) {
+	window := testSampleRate * 300 / 1000
+	step := testSampleRate / 10
+	var tp, fp, fn int
+	for start := 0; start+window <= len(rec.pcm); start += step {
+		var speech int
+		for _, s := range rec.speech[start : start+window] {
+			if s {
+				speech++
+			}
+		}
+		if speech != 0 && speech != window {
+			continue
+		}
+		got := det.Detect(rec.pcm[start : start+window])
+		want := speech == window
+		switch {
+		case got && want:
+			tp++
+		case got && !want:
+			fp++
+		case !got && want:
+			fn++
+		}
+	}
+	if tp+fp > 0 {
+		precision = float64(tp) / float64(tp+fp)
+	}
+	if tp+fn > 0 {
+		recall = float64(tp) / float64(tp+fn)
+	}
+	return precision, recall
+}
+
+func TestDetectors(t *testing.T) {
+	recs := loadRecordings(t)
+	recs["synthetic"] = syntheticRecording()
+	for _, tt := range []struct {
+		backend Backend
+		// minimums on the synthetic recording, others are only reported
+		precision, recall float64
+	}{
+		// loud noise and hum count as speech for the energy detector
+		{Energy, 0.5, 0.5},
+		// hum and noise bursts count for the GMM until its noise model
+		// catches up with them
+		{GMM, 0.75, 0.9},
+		{Spectral, 0.9, 0.9},
+	} {
+		for name, rec := range recs {
+			det, err := NewDetector(tt.backend, testSampleRate)
+			require.NoError(t, err)
+			precision, recall := evaluate(det, rec)
+			t.Logf("%s on %s: precision %.2f recall %.2f", tt.backend, name, precision, recall)
+			if name == "synthetic" {
+				assert.Assert(t, precision >= tt.precision, "%s precision %.2f", tt.backend, precision)
+				assert.Assert(t, recall >= tt.recall, "%s recall %.2f", tt.backend, recall)
+			}
+		}
+	}
+
+	_, err := NewDetector("nope", testSampleRate)
+	assert.ErrorContains(t, err, "unknown backend")
+}
+
+func TestGMMRisingNoise(t *testing.T) {
+	// the background gets louder until it's as loud as the noise burst in
+	// the synthetic recording, then someone speaks over it
+	rng := rand.New(rand.NewSource(2))
+	rec := &labeledAudio{}
+	rec.add(false, whiteNoise(rng, time.Second, 0.0005))
+	rec.add(true, mix(syntheticSpeech(rng, time.Second, 0.2), whiteNoise(rng, time.Second, 0.0005)))
+	ramp := whiteNoise(rng, 4*time.Second, 1)
+	for i := range ramp {
+		ramp[i] *= float32(0.0005 + 0.0495*float64(i)/float64(len(ramp)))
+	}
+	rec.add(false, ramp)
+	rec.add(false, whiteNoise(rng, 4*time.Second, 0.05))
+	adapted := len(rec.pcm)
+	rec.add(false, whiteNoise(rng, 2*time.Second, 0.05))
+	rec.add(true, mix(syntheticSpeech(rng, 2*time.Second, 0.3), whiteNoise(rng, 2*time.Second, 0.05)))
+
+	det := NewGMMDetector(testSampleRate)
+	evaluate(det, &labeledAudio{pcm: rec.pcm[:adapted], speech: rec.speech[:adapted]})
+	precision, recall := evaluate(det, &labeledAudio{pcm: rec.pcm[adapted:], speech: rec.speech[adapted:]})
+	// the noise is only about 15dB below the speech, the quiet ends of
+	// syllables get lost in it
+	assert.Assert(t, precision >= 0.9, "precision %.2f", precision)
+	assert.Assert(t, recall >= 0.75, "recall %.2f", recall)
+}
+
+func TestFFT(t *testing.T) {
+	// a sine in the middle of a bin should show up at full scale in it
+	s := newSpectrum(256)
+	frame := make([]float32, 256)
+	for i := range frame {
+		frame[i] = float32(math.Sin(2 * math.Pi * 16 * float64(i) / 256))
+	}
+	power := s.compute(frame)
+	assert.Assert(t, math.Abs(power[16]-1) < 0.05, "power %v", power[16])
+	assert.Assert(t, power[40] < 1e-6, "power %v", power[40])
+}
@@ -0,0 +1,74 @@
+package vad
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+)
+
+// CapturedSample is audio pushed to an Engine, along with the RTP packet it
+// was decoded from if there is one.
+type CapturedSample struct {
+	PCM []float32
+	// EndTimestamp is the end of the audio in milliseconds.
+	EndTimestamp uint32
+	Packet       *rtp.Packet
+}
+
+// CapturedAudio is ongoing or finished speech. It has all the audio pushed
+// since the last final one, and the packets it was decoded from.
+type CapturedAudio struct {
+	ID string `json:"id"`
+
+	PCM     []float32     `json:"-"`
+	Packets []*rtp.Packet `json:"-"`
+
+	Final bool `json:"final"`
+
+	// StartTimestamp and EndTimestamp are the span of PCM in milliseconds.
+	StartTimestamp uint64 `json:"start"`
+	EndTimestamp   uint64 `json:"end"`
+}
+
+// Engine detects speech in samples pushed to it, for audio that isn't on a
+// track. It works the same as the Agent does for each track.
+type Engine struct {
+	window  *Window
+	packets []*rtp.Packet
+}
+
+// NewEngine returns a new engine, it panics if the backend is unknown.
+func NewEngine(config Config) *Engine {
+	return &Engine{window: New(config).newWindow()}
+}
+
+// Push adds a sample and returns the speech so far every MaxPending while
+// someone is speaking, then the final speech once they stop. Otherwise it
+// returns nil.
+func (e *Engine) Push(captured *CapturedSample) *CapturedAudio {
+	w := e.window
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.flushed {
+		e.packets = e.packets[:0]
+	}
+	if captured.Packet != nil {
+		e.packets = append(e.packets, captured.Packet)
+	}
+
+	end := tracks.Timestamp(time.Duration(captured.EndTimestamp) * time.Millisecond)
+	_, activity := w.push(captured.PCM, end)
+	if activity == NoActivity {
+		return nil
+	}
+	length := uint64(len(w.pcm) / w.vad.sampleRateMs)
+	return &CapturedAudio{
+		ID:             w.chunkID,
+		PCM:            append([]float32(nil), w.pcm...),
+		Packets:        append([]*rtp.Packet(nil), e.packets...),
+		Final:          activity == SpeechEnded,
+		StartTimestamp: uint64(captured.EndTimestamp) - min(length, uint64(captured.EndTimestamp)),
+		EndTimestamp:   uint64(captured.EndTimestamp),
+	}
+}
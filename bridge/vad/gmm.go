@@ -0,0 +1,241 @@
+package vad
+
+import (
+	"math"
+	"slices"
+)
+
+// gmmBands are the frequency bands the GMM detector looks at, the same ones
+// the WebRTC VAD splits its 8kHz input into.
+var gmmBands = [][2]float64{
+	{80, 250}, {250, 500}, {500, 1000}, {1000, 2000}, {2000, 3000}, {3000, 4000},
+}
+
+const (
+	// gmmNoiseRate and gmmSpeechRate are how much of the way the models move
+	// towards each 10ms frame of their kind.
+	gmmNoiseRate  = 0.02
+	gmmSpeechRate = 0.01
+	// gmmNoiseMinStd and gmmSpeechMinStd keep the models from collapsing
+	// onto steady audio, in dB.
+	gmmNoiseMinStd  = 3
+	gmmSpeechMinStd = 6
+	// gmmMinDiff is how far above the noise the speech model is kept, in dB.
+	gmmMinDiff = 10
+	// gmmFloorFrames is how many frames back the minimum energy of each band
+	// is tracked. When even that is above the noise model the noise got
+	// louder, and the model is raised towards it whether the frames are taken
+	// for speech or not.
+	gmmFloorFrames = 100
+)
+
+type gaussian struct {
+	weight, mean, std float64
+}
+
+func (g gaussian) logDensity(x float64) float64 {
+	z := (x - g.mean) / g.std
+	return math.Log(g.weight) - math.Log(g.std*math.Sqrt(2*math.Pi)) - z*z/2
+}
+
+type mixture []gaussian
+
+func (m mixture) logLikelihood(x float64) float64 {
+	var p float64
+	for _, g := range m {
+		p += math.Exp(g.logDensity(x))
+	}
+	return math.Log(p + 1e-300)
+}
+
+// mean is the mean of the whole mixture.
+func (m mixture) mean() float64 {
+	var mean float64
+	for _, g := range m {
+		mean += g.weight * g.mean
+	}
+	return mean
+}
+
+// adapt moves each Gaussian towards x by rate, weighted by how likely it is
+// x came from it, keeping the deviations at least minStd.
+func (m mixture) adapt(x, rate, minStd float64) {
+	// the responsibilities are worked out from log densities so audio far
+	// from every Gaussian still goes to the closest one
+	top := math.Inf(-1)
+	for _, g := range m {
+		top = max(top, g.logDensity(x))
+	}
+	var total float64
+	for _, g := range m {
+		total += math.Exp(g.logDensity(x) - top)
+	}
+	for i := range m {
+		g := &m[i]
+		r := math.Exp(g.logDensity(x)-top) / total
+		d := x - g.mean
+		g.mean += rate * r * d
+		v := g.std*g.std + rate*r*(d*d-g.std*g.std)
+		g.std = max(math.Sqrt(v), minStd)
+	}
+}
+
+// shift moves all the Gaussians by d.
+func (m mixture) shift(d float64) {
+	for i := range m {
+		m[i].mean += d
+	}
+}
+
+// GMMDetector classifies 10ms frames by the log energy in each of the
+// gmmBands, comparing how likely it is under a mixture model of speech and
+// one of background noise. A frame is speech if the likelihood ratio summed
+// over all bands passes Threshold, or the ratio of any one band passes
+// BandThreshold, which catches speech that's only strong in a few bands.
+//
+// Like the WebRTC VAD the models adapt to the audio: after each frame the
+// noise model is updated from frames that look like noise and the speech model
+// from frames taken for speech. The noise model is also raised to the lowest
+// energy of the last second, and the speech model is kept above the noise,
+// so background noise that gets louder stops counting as speech after a few
+// seconds.
+type GMMDetector struct {
+	Threshold     float64
+	BandThreshold float64
+	// Speech and Noise are the models for each band, of the band energy in
+	// dB relative to a full scale sine. They're updated as frames are
+	// detected.
+	Speech, Noise []mixture
+
+	// history is the energy of each band over the last gmmFloorFrames frames
+	history [][]float64
+	frame   int
+	db      []float64
+	// tail is the end of the audio of the last Detect
+	tail []float32
+
+	frameSize int
+	bins      [][2]int
+	spectrum  *spectrum
+}
+
+func NewGMMDetector(sampleRate int) *GMMDetector {
+	d := &GMMDetector{
+		Threshold:     6,
+		BandThreshold: 3,
+		frameSize:     sampleRate / 100,
+	}
+	d.spectrum = newSpectrum(d.frameSize)
+	binHz := float64(sampleRate) / float64(len(d.spectrum.buf))
+	for i, band := range gmmBands {
+		lo := int(math.Ceil(band[0] / binHz))
+		hi := min(int(band[1]/binHz), len(d.spectrum.power)-1)
+		d.bins = append(d.bins, [2]int{lo, hi})
+		d.history = append(d.history, make([]float64, 0, gmmFloorFrames))
+		// speech has most of its energy low down, noise is roughly flat
+		tilt := float64(i) * 3
+		d.Speech = append(d.Speech, mixture{
+			{weight: 0.6, mean: -30 - tilt, std: 10},
+			{weight: 0.4, mean: -45 - tilt, std: 12},
+		})
+		d.Noise = append(d.Noise, mixture{
+			{weight: 0.6, mean: -80, std: 8},
+			{weight: 0.4, mean: -65, std: 8},
+		})
+	}
+	d.db = make([]float64, len(gmmBands))
+	return d
+}
+
+// Detect adapts the models only to the frames that weren't in the audio of
+// the last call, the agent passes it overlapping stretches of the track.
+func (d *GMMDetector) Detect(pcm []float32) bool {
+	fresh := d.fresh(pcm)
+	var total, speech, at int
+	frames(pcm, d.frameSize, func(frame []float32) {
+		total++
+		at += len(frame)
+		if d.isSpeech(frame, at > fresh) {
+			speech++
+		}
+	})
+	return total > 0 && float64(speech) >= speechRatio*float64(total)
+}
+
+// fresh returns where the audio after the end of the last call starts in
+// pcm, by finding the last frame of it.
+func (d *GMMDetector) fresh(pcm []float32) int {
+	start := 0
+	if n := len(d.tail); n > 0 {
+		for i := len(pcm) - n; i >= 0; i-- {
+			if slices.Equal(pcm[i:i+n], d.tail) {
+				start = i + n
+				break
+			}
+		}
+	}
+	d.tail = append(d.tail[:0], pcm[max(0, len(pcm)-d.frameSize):]...)
+	return start
+}
+
+// isSpeech classifies the frame and then adapts the models to it if adapt
+// is set.
+func (d *GMMDetector) isSpeech(frame []float32, adapt bool) bool {
+	power := d.spectrum.compute(frame)
+	var sum float64
+	speech := false
+	for i, bins := range d.bins {
+		var energy float64
+		for _, p := range power[bins[0] : bins[1]+1] {
+			energy += p
+		}
+		d.db[i] = 10 * math.Log10(energy+1e-12)
+		llr := d.Speech[i].logLikelihood(d.db[i]) - d.Noise[i].logLikelihood(d.db[i])
+		if d.db[i] < d.Noise[i].mean() {
+			// quieter than the noise, the wider speech model only wins
+			// because it falls off slower
+			llr = min(llr, 0)
+		}
+		if llr > d.BandThreshold {
+			speech = true
+		}
+		sum += llr
+	}
+	speech = speech || sum > d.Threshold
+	if adapt {
+		d.adapt(speech, sum < 0)
+	}
+	return speech
+}
+
+// adapt updates the models with the band energies of the last frame. Only
+// frames that are more likely noise than speech update the noise model, the
+// ones in between are often the quiet ends of speech.
+func (d *GMMDetector) adapt(speech, noise bool) {
+	for i, db := range d.db {
+		if len(d.history[i]) < gmmFloorFrames {
+			d.history[i] = append(d.history[i], db)
+		} else {
+			d.history[i][d.frame%gmmFloorFrames] = db
+		}
+		floor := math.Inf(1)
+		for _, h := range d.history[i] {
+			floor = min(floor, h)
+		}
+
+		n, s := d.Noise[i], d.Speech[i]
+		if speech {
+			s.adapt(db, gmmSpeechRate, gmmSpeechMinStd)
+		} else if noise {
+			n.adapt(db, gmmNoiseRate, gmmNoiseMinStd)
+		}
+		if floor > n.mean() {
+			n.shift(gmmNoiseRate * (floor - n.mean()))
+		}
+		lowest := n.mean() + gmmMinDiff
+		for j := range s {
+			s[j].mean = max(s[j].mean, lowest)
+		}
+	}
+	d.frame++
+}
@@ -0,0 +1,77 @@
+package vad
+
+import "math"
+
+// SpectralDetector looks at 20ms frames. A frame is voiced if it's louder
+// than MinEnergy and crosses zero less often than MaxZCR, since voiced speech
+// is dominated by its low pitch while noise crosses zero all the time. The
+// audio is speech if enough frames are voiced and the spectrum changes from
+// frame to frame by at least MinFlux on average, which steady sounds like hum
+// or a fan don't.
+type SpectralDetector struct {
+	MinEnergy float64
+	MaxZCR    float64
+	MinFlux   float64
+
+	frameSize int
+	spectrum  *spectrum
+	prev      []float64
+}
+
+func NewSpectralDetector(sampleRate int) *SpectralDetector {
+	d := &SpectralDetector{
+		MinEnergy: 1e-5,
+		MaxZCR:    0.25,
+		MinFlux:   0.1,
+		frameSize: sampleRate / 50,
+	}
+	d.spectrum = newSpectrum(d.frameSize)
+	d.prev = make([]float64, len(d.spectrum.power))
+	return d
+}
+
+func (d *SpectralDetector) Detect(pcm []float32) bool {
+	var total, voiced, fluxFrames int
+	var flux float64
+	first := true
+	frames(pcm, d.frameSize, func(frame []float32) {
+		total++
+		var energy float64
+		var crossings int
+		for i, v := range frame {
+			energy += float64(v) * float64(v)
+			if i > 0 && (v >= 0) != (frame[i-1] >= 0) {
+				crossings++
+			}
+		}
+		energy /= float64(len(frame))
+		zcr := float64(crossings) / float64(len(frame))
+		isVoiced := energy >= d.MinEnergy && zcr <= d.MaxZCR
+		if isVoiced {
+			voiced++
+		}
+
+		// flux of the magnitudes normalized by the total, so it doesn't
+		// depend on how loud the audio is
+		power := d.spectrum.compute(frame)
+		var rise, sum float64
+		for i, p := range power {
+			mag := math.Sqrt(p)
+			if !first {
+				rise += math.Max(0, mag-d.prev[i])
+			}
+			sum += mag
+			d.prev[i] = mag
+		}
+		if isVoiced && !first && sum > 0 {
+			flux += rise / sum
+			fluxFrames++
+		}
+		first = false
+	})
+	if fluxFrames == 0 {
+		return false
+	}
+	flux /= float64(fluxFrames)
+	return float64(voiced) >= speechRatio*float64(total) && flux >= d.MinFlux
+}
@@ -6,18 +6,26 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gopxl/beep"
 	"github.com/progrium/webrtc-sessions/bridge/audio"
 	"github.com/progrium/webrtc-sessions/bridge/tracks"
 	"github.com/rs/xid"
 )
 
+func init() {
+	// the activity events only have a span
+	tracks.RegisterEvent[any]("speech-start")
+	tracks.RegisterEvent[any]("activity-draft")
+	tracks.RegisterEvent[any]("activity")
+	tracks.RegisterEvent[any]("speech-end")
+}
+
 type Agent struct {
+	format        beep.Format
+	config        Config
 	sampleRateMs  int
 	maxWindowSize int
 
-	energyThresh  float32
-	silenceThresh float32
-
 	vadGapSamples int
 	maxPendingMs  int
 
@@ -25,17 +33,43 @@ type Agent struct {
 	mu      sync.Mutex
 }
 
+// Window is the detection state of one track. It's safe for concurrent use,
+// pushes are serialized.
 type Window struct {
-	vad *Agent
+	mu sync.Mutex
+
+	vad      *Agent
+	detector Detector
+	// noise is only tracked in adaptive mode
+	noise *noiseFloor
 
 	pcm     []float32
 	chunkID string
+	// flushed is set when the window is done with pcm, it's cleared on the
+	// next push so the audio is still around until then
+	flushed bool
 
 	isSpeaking      bool
 	pendingMs       int
 	startedSpeaking tracks.Timestamp
+	// draft is the "activity-draft" recorded for ongoing speech
+	draft tracks.Event
 }
 
+// Activity is what changed in the audio pushed to a Window.
+type Activity int
+
+const (
+	NoActivity Activity = iota
+	// SpeechStarted is reported when speech is first detected.
+	SpeechStarted
+	// SpeechContinued is reported every MaxPending while speech goes on.
+	SpeechContinued
+	// SpeechEnded is reported after Gap of silence, or when the window is
+	// full.
+	SpeechEnded
+)
+
 type Config struct {
 	// // This is determined by the hyperparameter configuration that whisper was trained on.
 	// // See more here: https://github.com/ggerganov/whisper.cpp/issues/909
@@ -45,6 +79,30 @@ type Config struct {
 	// // We will buffer up to (whisperSampleWindowMs - pcmSampleRateMs) of old audio and then add
 	// // audioSampleRateMs of new audio onto the end of the buffer for inference
 	SampleWindow time.Duration // = 24000 // 24 second sample window
+	// Backend is the Detector used, Energy if empty.
+	Backend Backend
+	// EnergyThresh and SilenceThresh are the mean energy and mean amplitude
+	// the Energy backend needs to see to start detecting speech, 0.0005 and
+	// 0.015 if zero.
+	EnergyThresh  float32
+	SilenceThresh float32
+	// StopRatio scales the Energy thresholds while speech goes on, so it
+	// takes quieter audio to stop than it took to start. 1 if zero, which
+	// turns the hysteresis off.
+	StopRatio float32
+	// Adaptive estimates the background noise of each track and sets the
+	// Energy thresholds relative to it instead, so speech has to be
+	// NoiseRatio times louder than the noise to start, 4 (6dB) if zero.
+	Adaptive   bool
+	NoiseRatio float32
+	// Gap is how long the silence that ends speech is, 700ms if zero.
+	Gap time.Duration
+	// PreRoll is how much audio from before speech was detected is included
+	// in it, 500ms if zero.
+	PreRoll time.Duration
+	// MaxPending is how often a draft of ongoing speech is flushed, 500ms if
+	// zero.
+	MaxPending time.Duration
 	// windowSize     = sampleWindowMs * sampleRateMs
 	// // This determines how often we will try to run inference.
 	// // We will buffer (pcmSampleRateMs * whisperSampleRate / 1000) samples and then run inference
@@ -52,36 +110,119 @@ type Config struct {
 	// pcmWindowSize   = pcmSampleRateMs * sampleRateMs
 }
 
+func (c *Config) setDefaults() {
+	if c.EnergyThresh == 0 {
+		c.EnergyThresh = defaultEnergyThresh
+	}
+	if c.SilenceThresh == 0 {
+		c.SilenceThresh = defaultSilenceThresh
+	}
+	if c.StopRatio == 0 {
+		c.StopRatio = defaultStopRatio
+	}
+	if c.NoiseRatio == 0 {
+		c.NoiseRatio = 4
+	}
+	if c.Gap == 0 {
+		c.Gap = 700 * time.Millisecond
+	}
+	if c.PreRoll == 0 {
+		c.PreRoll = 500 * time.Millisecond
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = 500 * time.Millisecond
+	}
+}
+
+// New returns a new agent, it panics if the backend is unknown.
 func New(config Config) *Agent {
+	if _, err := NewDetector(config.Backend, config.SampleRate); err != nil {
+		panic(err)
+	}
+	config.setDefaults()
 	sampleRateMs := config.SampleRate / 1000
 	pcmWindowSize := int(config.SampleWindow.Seconds() * float64(config.SampleRate))
 	return &Agent{
+		format: beep.Format{
+			SampleRate:  beep.SampleRate(config.SampleRate),
+			NumChannels: 1,
+			Precision:   2,
+		},
+		config:        config,
 		sampleRateMs:  sampleRateMs,
 		maxWindowSize: pcmWindowSize,
-		vadGapSamples: sampleRateMs * 700,
-		maxPendingMs:  500,
+		vadGapSamples: sampleRateMs * int(config.Gap.Milliseconds()),
+		maxPendingMs:  int(config.MaxPending.Milliseconds()),
 		windows:       make(map[string]*Window),
-
-		// this is an arbitrary number I picked after testing a bit
-		// feel free to play around
-		energyThresh:  0.0005,
-		silenceThresh: 0.015,
 	}
 }
 
+func (a *Agent) Subscription() tracks.Filter {
+	return tracks.Filter{Types: []string{"audio", "track-end"}}
+}
+
+// AudioFormat is the mono audio at the configured sample rate the detection
+// runs on.
+func (a *Agent) AudioFormat() beep.Format {
+	return a.format
+}
+
+// HandleEvent records a "speech-start" event and an "activity-draft" over
+// the speech so far when someone starts speaking, updates the draft as they
+// go on, then records the final "activity" superseding the draft and a
+// "speech-end" event when they stop. When the track ends any ongoing speech
+// is finished and the window of the track is dropped.
 func (a *Agent) HandleEvent(annot tracks.Event) {
-	if annot.Type != "audio" {
+	track := annot.Track()
+	if annot.Type == "track-end" {
+		w := a.evict(string(track.ID))
+		if w == nil {
+			return
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		start, activity := w.finish()
+		w.record(track, start, annot.End, activity)
 		return
 	}
-	pcm, err := audio.StreamAll(annot.Span().Audio())
+
+	pcm, err := audio.StreamAll(tracks.AudioAs(annot.Span(), a.format))
 	if err != nil {
 		log.Println("vad:", err)
 		return
 	}
-	win := a.Window(string(annot.Track().ID))
-	start, ok := win.Push(pcm, annot.End)
-	if ok && start != 0 {
-		annot.Track().Span(start, annot.End).RecordEvent("activity", nil)
+	w := a.Window(string(track.ID))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	start, activity := w.push(pcm, annot.End)
+	w.record(track, start, annot.End, activity)
+}
+
+// record records the events for activity on the track, w.mu must be held.
+func (w *Window) record(track *tracks.Track, start, end tracks.Timestamp, activity Activity) {
+	if activity == NoActivity {
+		return
+	}
+	// the pre-roll can reach back before the track
+	start = max(start, track.Start())
+	switch activity {
+	case SpeechStarted:
+		track.Span(start, start).RecordEvent("speech-start", nil)
+		w.draft = track.Span(start, end).RecordEvent("activity-draft", nil)
+	case SpeechContinued:
+		w.draft.End = end
+		track.UpdateEvent(w.draft)
+	case SpeechEnded:
+		var drafts []tracks.ID
+		if w.draft.ID != "" {
+			drafts = append(drafts, w.draft.ID)
+		} else {
+			// it started and ended in one push
+			track.Span(start, start).RecordEvent("speech-start", nil)
+		}
+		tracks.Supersede(track.Span(start, end), "activity", nil, drafts...)
+		track.Span(end, end).RecordEvent("speech-end", nil)
+		w.draft = tracks.Event{}
 	}
 }
 
@@ -89,20 +230,65 @@ func (a *Agent) Window(name string) *Window {
 	a.mu.Lock()
 	w, ok := a.windows[name]
 	if !ok {
-		w = &Window{
-			vad:        a,
-			pendingMs:  0,
-			pcm:        make([]float32, 0, a.maxWindowSize),
-			isSpeaking: false,
-		}
+		w = a.newWindow()
 		a.windows[name] = w
 	}
 	a.mu.Unlock()
 	return w
 }
 
-// pushes audio and returns edge==true on activity changes,
-func (w *Window) Push(pcm []float32, end tracks.Timestamp) (start tracks.Timestamp, ok bool) {
+// evict removes the window of a track and returns it, or nil if there
+// isn't one.
+func (a *Agent) evict(name string) *Window {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w := a.windows[name]
+	delete(a.windows, name)
+	return w
+}
+
+// Windows returns the number of tracks the agent keeps a window for.
+func (a *Agent) Windows() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.windows)
+}
+
+func (a *Agent) newWindow() *Window {
+	// checked by New
+	detector, _ := NewDetector(a.config.Backend, int(a.format.SampleRate))
+	if d, ok := detector.(*EnergyDetector); ok {
+		d.EnergyThresh = a.config.EnergyThresh
+		d.SilenceThresh = a.config.SilenceThresh
+		d.StopRatio = a.config.StopRatio
+	}
+	w := &Window{
+		vad:        a,
+		detector:   detector,
+		pendingMs:  0,
+		pcm:        make([]float32, 0, a.maxWindowSize),
+		isSpeaking: false,
+	}
+	if a.config.Adaptive {
+		w.noise = newNoiseFloor(int(a.format.SampleRate))
+	}
+	return w
+}
+
+// Push adds audio ending at end to the window and returns what changed,
+// along with when the current speech started, including the pre-roll.
+func (w *Window) Push(pcm []float32, end tracks.Timestamp) (start tracks.Timestamp, activity Activity) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.push(pcm, end)
+}
+
+func (w *Window) push(pcm []float32, end tracks.Timestamp) (start tracks.Timestamp, activity Activity) {
+	if w.flushed {
+		w.chunkID = ""
+		w.pcm = w.pcm[:0]
+		w.flushed = false
+	}
 	if w.chunkID == "" {
 		w.chunkID = xid.New().String()
 	}
@@ -127,55 +313,77 @@ func (w *Window) Push(pcm []float32, end tracks.Timestamp) (start tracks.Timesta
 		vadStartIx = 0
 	}
 
+	if w.noise != nil {
+		w.adapt(pcm)
+	}
+
 	wasSpeaking := w.isSpeaking
-	isSpeaking, energy, silence := VAD(w.pcm[vadStartIx:], w.vad.energyThresh, w.vad.silenceThresh)
-	//log.Printf("isSpeaking %v energy %v silence %v", isSpeaking, energy, silence)
+	isSpeaking := w.detector.Detect(w.pcm[vadStartIx:])
 	if isSpeaking {
 		w.isSpeaking = true
 	}
 
+	if isSpeaking && !wasSpeaking {
+		// add a little extra at the beginning
+		preRollMs := int(w.vad.config.PreRoll.Milliseconds())
+		w.startedSpeaking = end - tracks.Timestamp((len(pcm)/w.vad.sampleRateMs+preRollMs)*1000000)
+		w.pendingMs = 0
+		log.Println("STARTED SPEAKING", w.chunkID)
+	}
+
 	if len(w.pcm) != 0 && !isSpeaking && wasSpeaking {
 		log.Println("FINISHED SPEAKING", w.chunkID)
 		flushFinal = true
 	}
 
 	if flushFinal {
-		started := w.startedSpeaking
-		w.chunkID = ""
-		w.isSpeaking = false
-		w.pcm = w.pcm[:0]
-		w.pendingMs = 0
-		w.startedSpeaking = 0
-
-		_ = silence
-		_ = energy
-		// not speaking do nothing
-		// Logger.Infof("NOT SPEAKING energy=%#v (energyThreshold=%#v) silence=%#v (silenceThreshold=%#v) endTimestamp=%d ", energy, e.energyThresh, silence, e.silenceThresh, endTimestamp)
-		return started, true
+		return w.finish()
 	}
 
-	if isSpeaking && wasSpeaking {
-		//log.Println("STILL SPEAKING")
+	if isSpeaking && !wasSpeaking {
+		return w.startedSpeaking, SpeechStarted
 	}
 
-	if isSpeaking && !wasSpeaking {
-		// add a little extra 500ms at the beginning
-		w.startedSpeaking = end - tracks.Timestamp((len(pcm)/w.vad.sampleRateMs+500)*1000000)
-		log.Println("STARTED SPEAKING", w.chunkID)
+	if w.pendingMs >= w.vad.maxPendingMs && isSpeaking {
+		w.pendingMs = 0
+		return w.startedSpeaking, SpeechContinued
 	}
 
-	flushDraft := false
+	return 0, NoActivity
+}
 
-	if w.pendingMs >= w.vad.maxPendingMs && isSpeaking {
-		flushDraft = true
+// finish flushes the window, ending any ongoing speech.
+func (w *Window) finish() (start tracks.Timestamp, activity Activity) {
+	spoke := w.isSpeaking
+	started := w.startedSpeaking
+	w.flushed = true
+	w.isSpeaking = false
+	w.pendingMs = 0
+	w.startedSpeaking = 0
+	if r, ok := w.detector.(resetter); ok {
+		r.Reset()
 	}
 
-	if flushDraft {
-		w.pendingMs = 0
-		return w.startedSpeaking, false
+	if !spoke {
+		// not speaking do nothing
+		return 0, NoActivity
 	}
+	return started, SpeechEnded
+}
 
-	return 0, false
+// adapt updates the noise floor with new audio and moves the Energy
+// thresholds to sit NoiseRatio above it, keeping the configured ratio of
+// SilenceThresh to EnergyThresh.
+func (w *Window) adapt(pcm []float32) {
+	w.noise.update(pcm)
+	d, ok := w.detector.(*EnergyDetector)
+	if !ok {
+		return
+	}
+	config := w.vad.config
+	d.EnergyThresh = float32(w.noise.energy) * config.NoiseRatio
+	scale := math.Sqrt(float64(d.EnergyThresh / config.EnergyThresh))
+	d.SilenceThresh = config.SilenceThresh * float32(scale)
 }
 
 // NOTE This is a very rough implemntation. We should improve it :D
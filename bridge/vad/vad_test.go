@@ -0,0 +1,309 @@
+package vad
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gopxl/beep"
+	"github.com/pion/rtp"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
+	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"gotest.tools/assert"
+)
+
+// utterances pushes the audio through a window in 100ms chunks and returns
+// the speech it finished, as start and end times.
+func utterances(w *Window, pcm []float32) (found [][2]time.Duration) {
+	chunk := testSampleRate / 10
+	for i := 0; i+chunk <= len(pcm); i += chunk {
+		end := tracks.Timestamp(time.Duration(i+chunk) * time.Second / testSampleRate)
+		if start, activity := w.Push(pcm[i:i+chunk], end); activity == SpeechEnded {
+			found = append(found, [2]time.Duration{time.Duration(start), time.Duration(end)})
+		}
+	}
+	return found
+}
+
+func TestAdaptive(t *testing.T) {
+	// a room loud enough to pass the default thresholds on its own
+	rng := rand.New(rand.NewSource(1))
+	noise := func(d time.Duration) []float32 {
+		return whiteNoise(rng, d, 0.03)
+	}
+	rec := &labeledAudio{}
+	rec.add(false, noise(2*time.Second))
+	rec.add(true, mix(syntheticSpeech(rng, 2*time.Second, 0.3), noise(2*time.Second)))
+	rec.add(false, noise(2*time.Second))
+	rec.add(true, mix(syntheticSpeech(rng, time.Second, 0.3), noise(time.Second)))
+	rec.add(false, noise(2*time.Second))
+
+	config := Config{SampleRate: testSampleRate, SampleWindow: 24 * time.Second}
+	fixed := New(config)
+	assert.Equal(t, len(utterances(fixed.Window("t"), rec.pcm)), 0)
+
+	config.Adaptive = true
+	adaptive := New(config)
+	found := utterances(adaptive.Window("t"), rec.pcm)
+	assert.Equal(t, len(found), 2, "%v", found)
+	for i, want := range [][2]time.Duration{{2 * time.Second, 4 * time.Second}, {6 * time.Second, 7 * time.Second}} {
+		// the start includes the pre-roll and the end the gap
+		assert.Assert(t, found[i][0] >= want[0]-time.Second && found[i][0] <= want[0]+300*time.Millisecond, "%v", found)
+		assert.Assert(t, found[i][1] >= want[1] && found[i][1] <= want[1]+1500*time.Millisecond, "%v", found)
+	}
+}
+
+// square is n samples of a square wave of the given amplitude, its energy
+// is the square of it.
+func square(amp float32, n int) []float32 {
+	pcm := make([]float32, n)
+	for i := range pcm {
+		pcm[i] = amp
+		if i%2 == 1 {
+			pcm[i] = -amp
+		}
+	}
+	return pcm
+}
+
+func TestHysteresis(t *testing.T) {
+	d := &EnergyDetector{EnergyThresh: 0.01, SilenceThresh: 0.05, StopRatio: 0.5}
+	level := func(amp float32) []float32 {
+		return square(amp, 100)
+	}
+	// energy 0.0064, under the start threshold but over the stop one
+	assert.Assert(t, !d.Detect(level(0.08)))
+	assert.Assert(t, d.Detect(level(0.2)))
+	assert.Assert(t, d.Detect(level(0.08)))
+	assert.Assert(t, !d.Detect(level(0.05)))
+	assert.Assert(t, !d.Detect(level(0.08)))
+
+	// no hysteresis by default
+	d = New(Config{SampleRate: testSampleRate, SampleWindow: time.Second}).newWindow().detector.(*EnergyDetector)
+	assert.Equal(t, d.StopRatio, float32(1))
+}
+
+func TestResetOnFlush(t *testing.T) {
+	w := New(Config{
+		SampleRate:    testSampleRate,
+		SampleWindow:  time.Second,
+		EnergyThresh:  0.01,
+		SilenceThresh: 0.05,
+		StopRatio:     0.5,
+	}).Window("t")
+	chunk := testSampleRate / 10
+	push := func(amp float32, i int) Activity {
+		end := tracks.Timestamp(time.Duration(i+1) * 100 * time.Millisecond)
+		_, activity := w.Push(square(amp, chunk), end)
+		return activity
+	}
+	var i int
+	for ; i < 10; i++ {
+		push(0.2, i)
+	}
+	// the window filled up while still speaking, the audio after it only
+	// passes the stop thresholds so it isn't new speech
+	for ; i < 20; i++ {
+		assert.Equal(t, push(0.08, i), NoActivity, "chunk %d", i)
+	}
+}
+
+func TestAgentEvents(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	rec := &labeledAudio{}
+	// speech right away so the pre-roll reaches back before the track
+	rec.add(true, syntheticSpeech(rng, 2*time.Second, 0.3))
+	rec.add(false, whiteNoise(rng, 2*time.Second, 0.0005))
+
+	format := beep.Format{SampleRate: testSampleRate, NumChannels: 1, Precision: 2}
+	session := tracks.NewSession()
+	track := session.NewTrack(format)
+	session.Listen(New(Config{SampleRate: testSampleRate, SampleWindow: 24 * time.Second}))
+
+	var drafts []tracks.Event
+	session.Subscribe(tracks.HandlerFunc(func(e tracks.Event) {
+		drafts = append(drafts, e)
+	}), tracks.Filter{Types: []string{"activity-draft"}})
+
+	chunk := testSampleRate / 10
+	for i := 0; i+chunk <= len(rec.pcm); i += chunk {
+		buf := audio.NewBufferFromSamples(format, rec.pcm[i:i+chunk])
+		track.AddAudio(buf.Streamer(0, buf.Len()))
+	}
+	session.Wait()
+
+	starts := track.Events("speech-start")
+	activity := track.Events("activity")
+	ends := track.Events("speech-end")
+	assert.Equal(t, len(starts), 1)
+	assert.Equal(t, len(activity), 1)
+	assert.Equal(t, len(ends), 1)
+	assert.Equal(t, starts[0].Start, track.Start())
+	assert.Equal(t, activity[0].Start, track.Start())
+	assert.Equal(t, activity[0].End, ends[0].Start)
+	assert.Assert(t, time.Duration(activity[0].End) > 2*time.Second)
+
+	// the draft grew with each update and was superseded by the activity
+	assert.Equal(t, len(track.Events("activity-draft")), 0)
+	assert.Assert(t, len(drafts) > 2)
+	for i, draft := range drafts {
+		assert.Equal(t, draft.ID, drafts[0].ID)
+		assert.Equal(t, draft.Version, i)
+		if i > 0 {
+			assert.Assert(t, draft.End > drafts[i-1].End)
+		}
+	}
+	assert.DeepEqual(t, activity[0].Supersedes, []tracks.ID{drafts[0].ID})
+
+	// the events are registered so the session loads again
+	b, err := cbor.Marshal(session)
+	assert.NilError(t, err)
+	loaded := &tracks.Session{}
+	assert.NilError(t, cbor.Unmarshal(b, loaded))
+	for _, typ := range []string{"speech-start", "activity", "speech-end"} {
+		assert.Equal(t, len(loaded.Track(track.ID).Events(typ)), 1)
+	}
+}
+
+func TestEngine(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	rec := &labeledAudio{}
+	rec.add(false, whiteNoise(rng, time.Second, 0.0005))
+	rec.add(true, syntheticSpeech(rng, 2*time.Second, 0.3))
+	rec.add(false, whiteNoise(rng, 2*time.Second, 0.0005))
+
+	engine := NewEngine(Config{SampleRate: testSampleRate, SampleWindow: 24 * time.Second})
+	chunk := testSampleRate / 10
+	var out []*CapturedAudio
+	for i := 0; i+chunk <= len(rec.pcm); i += chunk {
+		captured := engine.Push(&CapturedSample{
+			PCM:          rec.pcm[i : i+chunk],
+			EndTimestamp: uint32((i + chunk) * 1000 / testSampleRate),
+			Packet:       &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i / chunk)}},
+		})
+		if captured != nil {
+			out = append(out, captured)
+			if captured.Final {
+				break
+			}
+		}
+	}
+
+	assert.Assert(t, len(out) > 2)
+	final := out[len(out)-1]
+	assert.Assert(t, final.Final)
+	for _, draft := range out[:len(out)-1] {
+		assert.Assert(t, !draft.Final)
+		assert.Equal(t, draft.ID, final.ID)
+	}
+	// everything since the start, with a packet for each push
+	assert.Equal(t, final.StartTimestamp, uint64(0))
+	assert.Equal(t, len(final.PCM), int(final.EndTimestamp)*testSampleRate/1000)
+	assert.Equal(t, len(final.Packets), len(final.PCM)/chunk)
+	assert.Equal(t, final.Packets[len(final.Packets)-1].SequenceNumber, uint16(len(final.Packets)-1))
+
+	// the next push starts over
+	captured := engine.Push(&CapturedSample{PCM: rec.pcm[:chunk], EndTimestamp: uint32(final.EndTimestamp) + 100})
+	assert.Assert(t, captured == nil)
+	assert.Equal(t, len(engine.packets), 0)
+	assert.Equal(t, len(engine.window.pcm), chunk)
+}
+
+func TestConcurrentWindows(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	rec := &labeledAudio{}
+	rec.add(true, syntheticSpeech(rng, 2*time.Second, 0.3))
+	rec.add(false, whiteNoise(rng, 2*time.Second, 0.0005))
+
+	format := beep.Format{SampleRate: testSampleRate, NumChannels: 1, Precision: 2}
+	agent := New(Config{SampleRate: testSampleRate, SampleWindow: 24 * time.Second})
+	addAudio := func(track *tracks.Track) {
+		chunk := testSampleRate / 10
+		for i := 0; i+chunk <= len(rec.pcm); i += chunk {
+			buf := audio.NewBufferFromSamples(format, rec.pcm[i:i+chunk])
+			track.AddAudio(buf.Streamer(0, buf.Len()))
+		}
+	}
+
+	// sessions sharing the agent deliver their events to it concurrently
+	var sessions []*tracks.Session
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		session := tracks.NewSession()
+		session.Listen(agent)
+		sessions = append(sessions, session)
+		for j := 0; j < 2; j++ {
+			track := session.NewTrack(format)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				addAudio(track)
+			}()
+		}
+	}
+
+	// and events for one track can be handled at the same time too
+	session := tracks.NewSession()
+	var events []tracks.Event
+	session.Subscribe(tracks.HandlerFunc(func(e tracks.Event) {
+		events = append(events, e)
+	}), agent.Subscription())
+	addAudio(session.NewTrack(format))
+	session.Wait()
+	for _, e := range events {
+		wg.Add(1)
+		go func(e tracks.Event) {
+			defer wg.Done()
+			agent.HandleEvent(e)
+		}(e)
+	}
+	wg.Wait()
+	for _, s := range sessions {
+		s.Wait()
+	}
+	assert.Equal(t, agent.Windows(), 4*2+1)
+
+	session.Close()
+	session.Wait()
+	agent.HandleEvent(events[len(events)-1])
+	for _, s := range sessions {
+		s.Close()
+		s.Wait()
+		for _, track := range s.Tracks() {
+			assert.Equal(t, len(track.Events("activity")), 1)
+			assert.Equal(t, len(track.Events("activity-draft")), 0)
+		}
+	}
+	assert.Equal(t, agent.Windows(), 0)
+}
+
+func TestEvictOnTrackEnd(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	format := beep.Format{SampleRate: testSampleRate, NumChannels: 1, Precision: 2}
+	session := tracks.NewSession()
+	agent := New(Config{SampleRate: testSampleRate, SampleWindow: 24 * time.Second})
+	session.Listen(agent)
+
+	// the track ends while someone is still speaking
+	track := session.NewTrack(format)
+	pcm := syntheticSpeech(rng, 2*time.Second, 0.3)
+	chunk := testSampleRate / 10
+	for i := 0; i+chunk <= len(pcm); i += chunk {
+		buf := audio.NewBufferFromSamples(format, pcm[i:i+chunk])
+		track.AddAudio(buf.Streamer(0, buf.Len()))
+	}
+	session.Wait()
+	assert.Equal(t, agent.Windows(), 1)
+	assert.Equal(t, len(track.Events("activity-draft")), 1)
+
+	track.Close()
+	session.Wait()
+	assert.Equal(t, agent.Windows(), 0)
+	activity := track.Events("activity")
+	assert.Equal(t, len(activity), 1)
+	assert.Equal(t, activity[0].End, track.End())
+	assert.Equal(t, len(track.Events("speech-end")), 1)
+	assert.Equal(t, len(track.Events("activity-draft")), 0)
+}
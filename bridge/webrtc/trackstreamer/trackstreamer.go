@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/gopxl/beep"
+	"github.com/progrium/webrtc-sessions/bridge/audio"
 	"gopkg.in/hraban/opus.v2"
 
 	"github.com/pion/interceptor"
@@ -16,6 +17,9 @@ import (
 
 const (
 	decodeBufDuration = 60 * time.Millisecond
+	// the rate of the Opus RTP clock and what Opus decodes at natively, other
+	// rates are resampled from it
+	opusSampleRate = beep.SampleRate(48000)
 )
 
 type sampleDecoder interface {
@@ -31,17 +35,18 @@ type TrackStreamer struct {
 }
 
 func New(track RTPReader, format beep.Format) (beep.Streamer, error) {
-	dec, err := opus.NewDecoder(format.SampleRate.N(time.Second), format.NumChannels)
+	dec, err := opus.NewDecoder(opusSampleRate.N(time.Second), format.NumChannels)
 	if err != nil {
 		return nil, err
 	}
-	sampleBuffer := samplebuilder.New(20, &codecs.OpusPacket{}, uint32(format.SampleRate.N(time.Second)))
-	return &TrackStreamer{
-		format:    format,
-		decodeBuf: make([]float32, format.NumChannels*format.SampleRate.N(decodeBufDuration)),
+	sampleBuffer := samplebuilder.New(20, &codecs.OpusPacket{}, uint32(opusSampleRate.N(time.Second)))
+	s := &TrackStreamer{
+		format:    beep.Format{SampleRate: opusSampleRate, NumChannels: format.NumChannels, Precision: format.Precision},
+		decodeBuf: make([]float32, format.NumChannels*opusSampleRate.N(decodeBufDuration)),
 		dec:       dec,
 		reader:    NewSampledReader(track, sampleBuffer),
-	}, nil
+	}
+	return audio.Resample(s, opusSampleRate, format.SampleRate), nil
 }
 
 var _ beep.Streamer = (*TrackStreamer)(nil)
@@ -18,13 +18,13 @@ import (
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
 	"github.com/progrium/webrtc-sessions/bridge/tracks"
+	"github.com/progrium/webrtc-sessions/bridge/vad"
 	"github.com/progrium/webrtc-sessions/cmd/minibridge/bridge"
 	"github.com/progrium/webrtc-sessions/cmd/minibridge/diarize"
 	"github.com/progrium/webrtc-sessions/cmd/minibridge/transcribe"
 	"github.com/progrium/webrtc-sessions/local"
 	"github.com/progrium/webrtc-sessions/sfu"
 	"github.com/progrium/webrtc-sessions/trackstreamer"
-	"github.com/progrium/webrtc-sessions/vad"
 	"tractor.dev/toolkit-go/engine"
 )
 
@@ -105,7 +105,7 @@ func (m *Main) Serve(ctx context.Context) {
 		}()
 
 		trackAudio := sessTrack.Audio()
-		detector := vad.New(vad.Config{
+		detector := vad.NewEngine(vad.Config{
 			SampleRate:   m.format.SampleRate.N(time.Second),
 			SampleWindow: 24 * time.Second,
 		})